@@ -3,24 +3,17 @@ package main
 import (
 	"bufio"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 
-	"github.com/adrg/xdg"
-	"github.com/docker/cli/cli/config"
-	"github.com/docker/docker/pkg/homedir"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"gopkg.in/yaml.v2"
-
+	"github.com/docker-credential-magic/docker-credential-magic/internal/audit"
 	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
 	"github.com/docker-credential-magic/docker-credential-magic/internal/embedded/mappings"
-	"github.com/docker-credential-magic/docker-credential-magic/internal/types"
+	"github.com/docker-credential-magic/docker-credential-magic/internal/store"
+	"github.com/docker-credential-magic/docker-credential-magic/pkg/magic"
 )
 
 var (
@@ -28,12 +21,8 @@ var (
 	// -ldflags="-X main.Version=$TAG"
 	Version string
 
-	errorInvalidDomain = errors.New("supplied domain is invalid")
-
-	// TODO: should use existing cred helper/docker config if no match
-	errorHelperNotFound = errors.New("could not determine correct helper")
-
-	validHelper = regexp.MustCompile(`^[a-z0-9_-].*?$`)
+	// Details of the current "get" request, recorded in the audit log (if enabled)
+	getRequest *audit.Entry
 )
 
 func main() {
@@ -45,6 +34,12 @@ func main() {
 	switch subcommand {
 	case constants.HelperSubcommandGet:
 		subcommandGet()
+	case constants.HelperSubcommandStore:
+		subcommandStore()
+	case constants.HelperSubcommandErase:
+		subcommandErase()
+	case constants.HelperSubcommandList:
+		subcommandList()
 	case "home":
 		subcommandHome()
 	case "init":
@@ -56,8 +51,9 @@ func main() {
 }
 
 func usage() {
-	fmt.Printf("Usage: docker-credential-magic <%s|home|init|version>\n",
-		constants.HelperSubcommandGet)
+	fmt.Printf("Usage: docker-credential-magic <%s|%s|%s|%s|home|init|version>\n",
+		constants.HelperSubcommandGet, constants.HelperSubcommandStore,
+		constants.HelperSubcommandErase, constants.HelperSubcommandList)
 	os.Exit(1)
 }
 
@@ -65,40 +61,113 @@ func subcommandGet() {
 	scanner := bufio.NewScanner(os.Stdin)
 	scanner.Scan()
 	rawInput := scanner.Text()
-	domain, err := parseDomain(rawInput)
+	getRequest = audit.NewEntry(rawInput)
+	resolver, err := magic.NewResolver(magic.ResolverOptWithWriter(os.Stderr))
 	if err != nil {
-		// TODO: invalid domain includes "localhost:5000" etc.
-		// not supported for now
-		getFallback(rawInput)
+		fmt.Printf("[magic] %s\n", err.Error())
+		exitWithOutcome(audit.OutcomeError, 1)
 	}
-	helperExe, err := getHelperExecutable(domain)
+	env, err := resolver.RecursionEnv(rawInput)
 	if err != nil {
-		if err != errorHelperNotFound {
-			fmt.Printf("[magic] getting helper executable for domain: %s\n", err.Error())
-			os.Exit(1)
+		fmt.Printf("[magic] %s\n", err.Error())
+		exitWithOutcome(audit.OutcomeError, 1)
+	}
+	// Fallback helpers inherit the environment of this process
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		os.Setenv(parts[0], parts[1])
+	}
+	source, err := resolver.Resolve(rawInput)
+	if err != nil {
+		fmt.Printf("[magic] %s\n", err.Error())
+		exitWithOutcome(audit.OutcomeError, 1)
+	}
+	getRequest.Source = source.Filename
+	if source.Mapping != nil {
+		getRequest.Helper = source.Mapping.Helper
+	}
+	switch source.Kind {
+	case magic.SourceKindRefused:
+		fmt.Print(constants.AnonymousTokenResponse)
+		exitWithOutcome(audit.OutcomeRefused, 0)
+	case magic.SourceKindAnonymous:
+		// If no match and no fallback, send the anonymous token response
+		fmt.Print(constants.AnonymousTokenResponse)
+		exitWithOutcome(audit.OutcomeAnonymous, 0)
+	}
+	creds, err := resolver.GetFromSource(source)
+	if err != nil {
+		if err == magic.ErrCredentialsNotFound {
+			fmt.Println(err.Error())
+			exitWithOutcome(audit.OutcomeNotFound, 1)
 		}
-		getFallback(rawInput)
+		fmt.Printf("[magic] %s\n", err.Error())
+		exitWithOutcome(audit.OutcomeError, 1)
+	}
+	b, err := json.Marshal(creds)
+	if err != nil {
+		fmt.Printf("[magic] converting creds to json: %s\n", err.Error())
+		exitWithOutcome(audit.OutcomeError, 1)
+	}
+	fmt.Println(string(b))
+	if creds.IsAnonymous() {
+		exitWithOutcome(audit.OutcomeAnonymous, 0)
+	}
+	exitWithOutcome(audit.OutcomeSuccess, 0)
+}
+
+func subcommandStore() {
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Printf("[magic] reading credentials: %s\n", err.Error())
+		os.Exit(1)
+	}
+	var creds store.Credentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		fmt.Printf("[magic] parsing credentials: %s\n", err.Error())
+		os.Exit(1)
 	}
-	cmd := exec.Command(helperExe, constants.HelperSubcommandGet)
-	cmd.Stdin = strings.NewReader(rawInput)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	err = cmd.Run()
+	if err := getStore().Store(&creds); err != nil {
+		fmt.Printf("[magic] storing credentials: %s\n", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func subcommandErase() {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	rawInput := scanner.Text()
+	if err := getStore().Erase(rawInput); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func subcommandList() {
+	list, err := getStore().List()
 	if err != nil {
-		fmt.Printf("[magic] exec \"%s\": %s\n", helperExe, err.Error())
+		fmt.Printf("[magic] listing credentials: %s\n", err.Error())
 		os.Exit(1)
 	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		fmt.Printf("[magic] converting list to json: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(b))
 	os.Exit(0)
 }
 
 func subcommandHome() {
-	dockerCredentialMagicConfig := getDockerCredentialMagicConfig()
+	dockerCredentialMagicConfig := magic.DefaultConfigDir()
 	fmt.Println(dockerCredentialMagicConfig)
 	os.Exit(0)
 }
 
 func subcommandInit() {
-	dockerCredentialMagicConfig := getDockerCredentialMagicConfig()
+	dockerCredentialMagicConfig := magic.DefaultConfigDir()
 	dockerCredentialMagicConfigDirAbs, err := filepath.Abs(dockerCredentialMagicConfig)
 	if err != nil {
 		fmt.Printf("Error: '%s' is not a valid directory\n", dockerCredentialMagicConfig)
@@ -162,146 +231,39 @@ func subcommandVersion() {
 	os.Exit(0)
 }
 
-func getFallback(rawInput string) {
-	var fallback string
-
-	// If DOCKER_ORIG_CONFIG set, fallback to that
-	if orig := os.Getenv(constants.EnvVarDockerOrigConfig); orig != "" {
-		fallback = orig
-	} else {
-		// If ~/.docker/config.json exists, fallback to that
-		dockerHomeDir := filepath.Join(homedir.Get(), constants.DockerHomeDir)
-		dockerConfigFile := filepath.Join(dockerHomeDir, constants.DockerConfigFileBasename)
-		if _, err := os.Stat(dockerConfigFile); err == nil {
-			fallback = dockerHomeDir
+// Record the outcome of the current "get" request in the audit log (if enabled), then exit
+func exitWithOutcome(outcome string, code int) {
+	if getRequest != nil {
+		getRequest.Finish(outcome)
+		if err := writeAuditEntry(getRequest); err != nil {
+			fmt.Fprintf(os.Stderr, "[magic] writing audit log: %s\n", err.Error())
 		}
 	}
-
-	if fallback == "" {
-		// If no match and no fallback, send the anonymous token response
-		fmt.Print(constants.AnonymousTokenResponse)
-		os.Exit(0)
-	}
-
-	cf, err := config.Load(fallback)
-	if err != nil {
-		fmt.Printf("[magic] loading fallback config \"%s\": %s\n", fallback, err.Error())
-		os.Exit(1)
-	}
-
-	// In the following 2 scenarios we could end up with an endless loop, so short circuit
-	if cf.CredentialsStore == constants.MagicCredentialSuffix {
-		fmt.Print(constants.AnonymousTokenResponse)
-		os.Exit(0)
-	}
-	if v, ok := cf.CredentialHelpers[rawInput]; ok && v == constants.MagicCredentialSuffix {
-		fmt.Print(constants.AnonymousTokenResponse)
-		os.Exit(0)
-	}
-
-	cfg, err := cf.GetAuthConfig(rawInput)
-	if err != nil {
-		fmt.Printf("[magic] get auth config for domain: %s\n", err.Error())
-		fmt.Println(err.Error())
-		os.Exit(1)
-	}
-	creds := toCreds(&authn.AuthConfig{
-		Username:      cfg.Username,
-		Password:      cfg.Password,
-		Auth:          cfg.Auth,
-		IdentityToken: cfg.IdentityToken,
-		RegistryToken: cfg.RegistryToken,
-	})
-	b, err := json.Marshal(&creds)
-	if err != nil {
-		fmt.Printf("[magic] converting creds to json: %s\n", err.Error())
-		fmt.Println(err.Error())
-		os.Exit(1)
-	}
-	fmt.Println(string(b))
-	os.Exit(0)
-}
-
-func parseDomain(s string) (string, error) {
-	parts := strings.Split(s, ".")
-	numParts := len(parts)
-	if numParts < 2 {
-		return "", errorInvalidDomain
-	}
-	root := parts[numParts-2]
-	ext := parts[numParts-1]
-	if root == "" || ext == "" {
-		return "", errorInvalidDomain
-	}
-	domain := strings.Join([]string{root, ext}, ".")
-	return domain, nil
+	os.Exit(code)
 }
 
-func getHelperExecutable(domain string) (string, error) {
-	dockerCredentialMagicConfig := getDockerCredentialMagicConfig()
-	parentDir := filepath.Join(dockerCredentialMagicConfig, constants.MappingsSubdir)
-	parentDirAbs, err := filepath.Abs(parentDir)
+func writeAuditEntry(entry *audit.Entry) error {
+	settings, err := magic.LoadSettings(magic.DefaultConfigDir())
 	if err != nil {
-		return "", fmt.Errorf("'%s' is not a valid directory", dockerCredentialMagicConfig)
+		return err
 	}
-	notExistsErr := fmt.Errorf(
-		"Directory '%s' does not exist.\nHint: Try running \"docker-credential-magic init\"",
-		parentDirAbs)
-	if info, err := os.Stat(parentDirAbs); err != nil || !info.IsDir() {
-		return "", notExistsErr
+	if settings.AuditLog == "" {
+		return nil
 	}
-	items, err := ioutil.ReadDir(parentDirAbs)
-	if err != nil {
-		return "", notExistsErr
+	filename := settings.AuditLog
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(magic.DefaultConfigDir(), filename)
 	}
-	for _, item := range items {
-		filename := filepath.Join(parentDirAbs, item.Name())
-		b, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return "", fmt.Errorf("unable to open '%s': %v", filename, err)
-		}
-		var m types.HelperMapping
-		err = yaml.Unmarshal(b, &m)
-		if err != nil {
-			return "", fmt.Errorf("parsing mappings for '%s': %v", filename, err)
-		}
-		if !validHelper.MatchString(m.Helper) {
-			return "", fmt.Errorf("helper '%s' is invalid", m.Helper)
-		}
-		for _, d := range m.Domains {
-			if d == domain {
-				return fmt.Sprintf("%s-%s", constants.DockerCredentialPrefix, m.Helper), nil
-			}
-		}
-	}
-	return "", errorHelperNotFound
-}
-
-func getDockerCredentialMagicConfig() string {
-	if d := os.Getenv(constants.EnvVarDockerCredentialMagicConfig); d != "" {
-		return d
-	}
-	return filepath.Join(xdg.ConfigHome, constants.XDGConfigSubdir)
+	logger := audit.New(filename, settings.AuditLogMaxSize, settings.AuditLogMaxBackups)
+	return logger.Write(entry)
 }
 
-// Borrowed from:
-// https://github.com/google/go-containerregistry/blob/a0b9468898deb31e3eb35f97fa4f0d568e769296/cmd/crane/cmd/auth.go#L47
-type credentials struct {
-	Username string
-	Secret   string
-}
-
-// Borrowed from:
-// https://github.com/google/go-containerregistry/blob/a0b9468898deb31e3eb35f97fa4f0d568e769296/cmd/crane/cmd/auth.go#L53
-func toCreds(config *authn.AuthConfig) credentials {
-	creds := credentials{
-		Username: config.Username,
-		Secret:   config.Password,
-	}
-
-	if config.IdentityToken != "" {
-		creds.Username = "<token>"
-		creds.Secret = config.IdentityToken
+// Open the encrypted store, exiting if no key is configured
+func getStore() *store.FileStore {
+	key, err := store.KeyFromEnv()
+	if err != nil {
+		fmt.Printf("[magic] loading store key: %s\n", err.Error())
+		exitWithOutcome(audit.OutcomeError, 1)
 	}
-	return creds
+	return store.New(store.DefaultFilename(magic.DefaultConfigDir()), key)
 }
@@ -1,28 +1,70 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/spf13/cobra"
 
 	"github.com/docker-credential-magic/docker-credential-magic/pkg/magician"
 )
 
 type mutateSettings struct {
-	Tag            string
-	HelpersDir     string
-	MappingsDir    string
-	IncludeHelpers []string
+	Tag               string
+	HelpersDir        string
+	MappingsDir       string
+	IncludeHelpers    []string
+	DisablePathLookup bool
+	MagicKeychain     bool
+	SrcUsername       string
+	SrcPassword       string
+	SrcToken          string
+	DstUsername       string
+	DstPassword       string
+	DstToken          string
+	Insecure          bool
+	SrcInsecure       bool
+	DstInsecure       bool
+	CAFiles           []string
+	SrcCAFiles        []string
+	DstCAFiles        []string
+	Timeout           time.Duration
+	Platform          string
+	AllowArchMismatch bool
+	SkipUnsupported   bool
+	DryRun            bool
+	Output            string
+	SBOMFile          string
+	SBOMAttach        bool
+	SignKey           string
+	ProvenanceFile    string
+	ProvenanceAttach  bool
 }
 
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
 // Version can be set via:
 // -ldflags="-X main.Version=$TAG"
 var Version string
 
 func main() {
-	var mutate mutateSettings
+	var mutate, unmutate, inspect mutateSettings
 
 	rootCmd := &cobra.Command{
 		Use:   "docker-credential-magician",
@@ -49,13 +91,20 @@ func main() {
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ref := args[0]
-			opts := []magician.MutateOption{
-				magician.MutateOptWithWriter(os.Stdout),
-				magician.MutateOptWithUserAgent(
-					fmt.Sprintf("docker-credential-magician/%s", Version)),
+			if mutate.Output != outputText && mutate.Output != outputJSON {
+				return fmt.Errorf("invalid output %q, must be %s or %s", mutate.Output, outputText, outputJSON)
+			}
+			if mutate.Output == outputJSON && !mutate.DryRun {
+				return fmt.Errorf("--output %s requires --dry-run", outputJSON)
 			}
-			if tag := mutate.Tag; tag != "" {
-				opts = append(opts, magician.MutateOptWithTag(tag))
+			// Keep stdout clean for the JSON plan
+			writer := os.Stdout
+			if mutate.Output == outputJSON {
+				writer = os.Stderr
+			}
+			opts, err := getRegistryOptions(&mutate, writer)
+			if err != nil {
+				return err
 			}
 			if helpersDir := mutate.HelpersDir; helpersDir != "" {
 				opts = append(opts, magician.MutateOptWithHelpersDir(helpersDir))
@@ -66,21 +115,393 @@ func main() {
 			if len(mutate.IncludeHelpers) > 0 {
 				opts = append(opts, magician.MutateOptWithIncludeHelpers(mutate.IncludeHelpers))
 			}
-			return magician.Mutate(ref, opts...)
+			if mutate.DisablePathLookup {
+				opts = append(opts, magician.MutateOptWithDisablePathLookup(true))
+			}
+			if mutate.AllowArchMismatch {
+				opts = append(opts, magician.MutateOptWithAllowArchMismatch(true))
+			}
+			if mutate.SkipUnsupported {
+				opts = append(opts, magician.MutateOptWithSkipUnsupportedPlatforms(true))
+			}
+			if sbomFile := mutate.SBOMFile; sbomFile != "" {
+				opts = append(opts, magician.MutateOptWithSBOMFile(sbomFile))
+			}
+			if mutate.SBOMAttach {
+				opts = append(opts, magician.MutateOptWithSBOMAttach(true))
+			}
+			if signKey := mutate.SignKey; signKey != "" {
+				signer, err := magician.NewSignerFromKeyFile(signKey)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, magician.MutateOptWithSigner(signer))
+			}
+			if provenanceFile := mutate.ProvenanceFile; provenanceFile != "" {
+				opts = append(opts, magician.MutateOptWithProvenanceFile(provenanceFile))
+			}
+			if mutate.ProvenanceAttach {
+				opts = append(opts, magician.MutateOptWithProvenanceAttach(true))
+			}
+			return runWithContext(mutate.Timeout, func(ctx context.Context) error {
+				if !mutate.DryRun {
+					return magician.MutateWithContext(ctx, ref, opts...)
+				}
+				plan, err := magician.PlanWithContext(ctx, ref, opts...)
+				if err != nil {
+					return err
+				}
+				return printPlan(plan, mutate.Output)
+			})
 		},
 	}
-	mutateCmd.Flags().StringVarP(&mutate.Tag, "tag", "t", "", "push to custom location")
+	addRegistryFlags(mutateCmd, &mutate)
 	mutateCmd.Flags().StringVarP(&mutate.HelpersDir, "helpers-dir", "", "",
 		"path containing helpers")
 	mutateCmd.Flags().StringVarP(&mutate.MappingsDir, "mappings-dir", "", "",
 		"path containing mappings")
 	mutateCmd.Flags().StringArrayVarP(&mutate.IncludeHelpers, "include", "i",
 		[]string{}, "custom helpers to include")
-
+	mutateCmd.Flags().BoolVarP(&mutate.DisablePathLookup, "disable-path-lookup", "", false,
+		"only allow magic to use helpers in /opt/magic/bin")
+	mutateCmd.Flags().BoolVarP(&mutate.AllowArchMismatch, "allow-arch-mismatch", "", false,
+		"warn instead of failing if a helper is not built for the image platform")
+	mutateCmd.Flags().BoolVarP(&mutate.SkipUnsupported, "skip-unsupported-platforms", "", false,
+		"keep index images for platforms without helpers as-is, instead of failing")
+	mutateCmd.Flags().BoolVarP(&mutate.DryRun, "dry-run", "", false,
+		"build the new image and print what would be pushed, without pushing it")
+	mutateCmd.Flags().StringVarP(&mutate.Output, "output", "o", outputText,
+		"format of the --dry-run plan (text or json)")
+	mutateCmd.Flags().StringVarP(&mutate.SBOMFile, "sbom", "", "",
+		"write an SPDX SBOM of the helpers added to this file")
+	mutateCmd.Flags().BoolVarP(&mutate.SBOMAttach, "sbom-attach", "", false,
+		"push an SPDX SBOM of the helpers added as an OCI referrer of the new image")
+	mutateCmd.Flags().StringVarP(&mutate.SignKey, "sign-key", "", "",
+		"sign the new image with this PEM private key (ECDSA or ed25519)")
+	mutateCmd.Flags().StringVarP(&mutate.ProvenanceFile, "provenance", "", "",
+		"write an in-toto provenance attestation of the new image to this file")
+	mutateCmd.Flags().BoolVarP(&mutate.ProvenanceAttach, "provenance-attach", "", false,
+		"push an in-toto provenance attestation as an OCI referrer of the new image (requires --sign-key)")
 	rootCmd.AddCommand(mutateCmd)
 
+	unmutateCmd := &cobra.Command{
+		Use:   "unmutate",
+		Short: "Remove magic (helpers, mappings and env vars) from an image",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ref := args[0]
+			opts, err := getRegistryOptions(&unmutate, os.Stdout)
+			if err != nil {
+				return err
+			}
+			return runWithContext(unmutate.Timeout, func(ctx context.Context) error {
+				return magician.UnmutateWithContext(ctx, ref, opts...)
+			})
+		},
+	}
+	addRegistryFlags(unmutateCmd, &unmutate)
+	rootCmd.AddCommand(unmutateCmd)
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect",
+		Short: "Report the helpers, mappings and env vars added to an image",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ref := args[0]
+			if inspect.Output != outputText && inspect.Output != outputJSON {
+				return fmt.Errorf("invalid output %q, must be %s or %s", inspect.Output, outputText, outputJSON)
+			}
+			opts, err := getRegistryOptions(&inspect, os.Stderr)
+			if err != nil {
+				return err
+			}
+			return runWithContext(inspect.Timeout, func(ctx context.Context) error {
+				result, err := magician.InspectWithContext(ctx, ref, opts...)
+				if err != nil {
+					return err
+				}
+				return printInspectResult(result, inspect.Output)
+			})
+		},
+	}
+	addInspectFlags(inspectCmd, &inspect)
+	inspectCmd.Flags().StringVarP(&inspect.Output, "output", "o", outputText,
+		"output format (text or json)")
+	rootCmd.AddCommand(inspectCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalln(err.Error())
 		os.Exit(1)
 	}
 }
+
+// Register the flags shared by commands which pull and push images
+func addRegistryFlags(cmd *cobra.Command, settings *mutateSettings) {
+	cmd.Flags().StringVarP(&settings.Tag, "tag", "t", "", "push to custom location")
+	cmd.Flags().BoolVarP(&settings.MagicKeychain, "magic-keychain", "", false,
+		"resolve credentials for pull/push using magic mappings and local helpers")
+	cmd.Flags().BoolVarP(&settings.Insecure, "insecure", "", false,
+		"allow plain HTTP and unverified TLS for source and destination registries")
+	cmd.Flags().BoolVarP(&settings.SrcInsecure, "source-insecure", "", false,
+		"allow plain HTTP and unverified TLS for the source registry")
+	cmd.Flags().BoolVarP(&settings.DstInsecure, "destination-insecure", "", false,
+		"allow plain HTTP and unverified TLS for the destination registry")
+	cmd.Flags().StringArrayVarP(&settings.CAFiles, "ca-file", "", []string{},
+		"CA certificates (PEM) to trust for source and destination registries")
+	cmd.Flags().StringArrayVarP(&settings.SrcCAFiles, "source-ca-file", "", []string{},
+		"CA certificates (PEM) to trust for the source registry")
+	cmd.Flags().StringArrayVarP(&settings.DstCAFiles, "destination-ca-file", "", []string{},
+		"CA certificates (PEM) to trust for the destination registry")
+	cmd.Flags().StringVarP(&settings.Platform, "platform", "", "",
+		fmt.Sprintf("only %s the image for this platform (e.g. linux/arm64)", cmd.Name()))
+	cmd.Flags().DurationVarP(&settings.Timeout, "timeout", "", 0,
+		"maximum time to spend pulling, building and pushing (e.g. 5m, default no limit)")
+	cmd.Flags().StringVarP(&settings.SrcUsername, "source-username", "", "",
+		"username for pulling the source image")
+	cmd.Flags().StringVarP(&settings.SrcPassword, "source-password", "", "",
+		"password for pulling the source image (env:<VAR> or file:<path>)")
+	cmd.Flags().StringVarP(&settings.SrcToken, "source-token", "", "",
+		"bearer token for pulling the source image (env:<VAR> or file:<path>)")
+	cmd.Flags().StringVarP(&settings.DstUsername, "destination-username", "", "",
+		"username for pushing the new image")
+	cmd.Flags().StringVarP(&settings.DstPassword, "destination-password", "", "",
+		"password for pushing the new image (env:<VAR> or file:<path>)")
+	cmd.Flags().StringVarP(&settings.DstToken, "destination-token", "", "",
+		"bearer token for pushing the new image (env:<VAR> or file:<path>)")
+}
+
+// Register the flags for inspect, which only pulls a single image
+// (stored as the source settings, so they are handled by getRegistryOptions)
+func addInspectFlags(cmd *cobra.Command, settings *mutateSettings) {
+	cmd.Flags().BoolVarP(&settings.MagicKeychain, "magic-keychain", "", false,
+		"resolve credentials for pull using magic mappings and local helpers")
+	cmd.Flags().BoolVarP(&settings.SrcInsecure, "insecure", "", false,
+		"allow plain HTTP and unverified TLS for the registry")
+	cmd.Flags().StringArrayVarP(&settings.SrcCAFiles, "ca-file", "", []string{},
+		"CA certificates (PEM) to trust for the registry")
+	cmd.Flags().StringVarP(&settings.Platform, "platform", "", "",
+		"only inspect the image for this platform (e.g. linux/arm64)")
+	cmd.Flags().DurationVarP(&settings.Timeout, "timeout", "", 0,
+		"maximum time to spend pulling and inspecting (e.g. 5m, default no limit)")
+	cmd.Flags().StringVarP(&settings.SrcUsername, "username", "", "",
+		"username for pulling the image")
+	cmd.Flags().StringVarP(&settings.SrcPassword, "password", "", "",
+		"password for pulling the image (env:<VAR> or file:<path>)")
+	cmd.Flags().StringVarP(&settings.SrcToken, "token", "", "",
+		"bearer token for pulling the image (env:<VAR> or file:<path>)")
+}
+
+// Build the options for the flags registered by addRegistryFlags (or addInspectFlags)
+func getRegistryOptions(settings *mutateSettings, writer io.Writer) ([]magician.MutateOption, error) {
+	opts := []magician.MutateOption{
+		magician.MutateOptWithWriter(writer),
+		magician.MutateOptWithUserAgent(
+			fmt.Sprintf("docker-credential-magician/%s", Version)),
+	}
+	if tag := settings.Tag; tag != "" {
+		opts = append(opts, magician.MutateOptWithTag(tag))
+	}
+	if settings.MagicKeychain {
+		opts = append(opts, magician.MutateOptWithMagicKeychain(true))
+	}
+	if settings.Platform != "" {
+		platform, err := parsePlatform(settings.Platform)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, magician.MutateOptWithPlatform(*platform))
+	}
+	if settings.Insecure {
+		opts = append(opts, magician.MutateOptWithInsecure(true))
+	}
+	if settings.SrcInsecure {
+		opts = append(opts, magician.MutateOptWithSourceInsecure(true))
+	}
+	if settings.DstInsecure {
+		opts = append(opts, magician.MutateOptWithDestinationInsecure(true))
+	}
+	for _, caFile := range settings.CAFiles {
+		opts = append(opts, magician.MutateOptWithCACertFile(caFile))
+	}
+	for _, caFile := range settings.SrcCAFiles {
+		opts = append(opts, magician.MutateOptWithSourceCACertFile(caFile))
+	}
+	for _, caFile := range settings.DstCAFiles {
+		opts = append(opts, magician.MutateOptWithDestinationCACertFile(caFile))
+	}
+	srcAuth, err := getAuth(settings.SrcUsername, settings.SrcPassword, settings.SrcToken)
+	if err != nil {
+		return nil, fmt.Errorf("source credentials: %v", err)
+	}
+	if srcAuth != nil {
+		opts = append(opts, magician.MutateOptWithSourceAuth(srcAuth))
+	}
+	dstAuth, err := getAuth(settings.DstUsername, settings.DstPassword, settings.DstToken)
+	if err != nil {
+		return nil, fmt.Errorf("destination credentials: %v", err)
+	}
+	if dstAuth != nil {
+		opts = append(opts, magician.MutateOptWithDestinationAuth(dstAuth))
+	}
+	return opts, nil
+}
+
+// Run with a context which is canceled on Ctrl-C (a second Ctrl-C exits immediately),
+// or once the timeout (if any) expires
+func runWithContext(timeout time.Duration, run func(ctx context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err := run(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %v", timeout, err)
+	}
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("interrupted: %v", err)
+	}
+	return err
+}
+
+// Print the plan of a dry run, either for humans or as JSON
+func printPlan(plan *magician.MutatePlan, output string) error {
+	if output == outputJSON {
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return fmt.Errorf("converting plan to json: %v", err)
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Source:\t%s\n", plan.Source)
+	fmt.Fprintf(w, "Destination:\t%s\n", plan.Destination)
+	fmt.Fprintf(w, "Digest:\t%s\n", plan.Digest)
+	for _, image := range plan.Images {
+		fmt.Fprintf(w, "\nPlatform %s (%s -> %s)\n", image.Platform, image.BaseDigest, image.Digest)
+		if image.UnmutatedDigest != image.BaseDigest {
+			fmt.Fprintf(w, "  (%s without magic)\n", image.UnmutatedDigest)
+		}
+		fmt.Fprintln(w, "  PATH\tSIZE\tMODE\tSHA256")
+		for _, file := range image.Files {
+			fmt.Fprintf(w, "  %s\t%d\t%s\t%s\n", file.Path, file.Size, file.Mode, file.Sha256)
+		}
+		fmt.Fprintln(w, "  ENV\tBEFORE\tAFTER")
+		for _, envVar := range image.Env {
+			after := fmt.Sprintf("%q", envVar.New)
+			if !envVar.Changed() {
+				after = "(unchanged)"
+			}
+			fmt.Fprintf(w, "  %s\t%q\t%s\n", envVar.Name, envVar.Old, after)
+		}
+	}
+	return w.Flush()
+}
+
+// Print the result of inspecting an image, either for humans or as JSON
+func printInspectResult(result *magician.InspectResult, output string) error {
+	if output == outputJSON {
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("converting result to json: %v", err)
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Source:\t%s\n", result.Source)
+	for _, image := range result.Images {
+		fmt.Fprintf(w, "\nPlatform %s (%s)\n", image.Platform, image.Digest)
+		if !image.Magic {
+			fmt.Fprintln(w, "  No magic found")
+			continue
+		}
+		if image.MagicianVersion != "" {
+			fmt.Fprintf(w, "  Created by:\t%s\n", image.MagicianVersion)
+		}
+		fmt.Fprintln(w, "  HELPER\tPATH\tSIZE\tSHA256")
+		for _, helper := range image.Helpers {
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%s\n", helper.Name, helper.Path, helper.Size, helper.Sha256)
+		}
+		fmt.Fprintln(w, "  MAPPING\tHELPER\tDOMAINS")
+		for _, mapping := range image.Mappings {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", mapping.Slug, mapping.Helper, strings.Join(mapping.Domains, ", "))
+		}
+		fmt.Fprintln(w, "  ENV\tVALUE")
+		for _, envVar := range image.Env {
+			fmt.Fprintf(w, "  %s\t%q\n", envVar.Name, envVar.Value)
+		}
+	}
+	return w.Flush()
+}
+
+// Parse a platform in the form "os/arch" or "os/arch/variant"
+func parsePlatform(value string) (*v1.Platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, must be in the form os/arch[/variant]", value)
+	}
+	platform := &v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// Build basic or bearer credentials from flag values, or nil if none provided
+func getAuth(username string, password string, token string) (authn.Authenticator, error) {
+	if token != "" {
+		if username != "" || password != "" {
+			return nil, fmt.Errorf("a token cannot be combined with a username or password")
+		}
+		secret, err := readSecret(token)
+		if err != nil {
+			return nil, err
+		}
+		return &authn.Bearer{Token: secret}, nil
+	}
+	if username == "" && password == "" {
+		return nil, nil
+	}
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("both a username and password must be provided")
+	}
+	secret, err := readSecret(password)
+	if err != nil {
+		return nil, err
+	}
+	return &authn.Basic{Username: username, Password: secret}, nil
+}
+
+// Secrets are never passed directly on the command line, but read
+// from an environment variable ("env:<VAR>") or a file ("file:<path>")
+func readSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		filename := strings.TrimPrefix(value, "file:")
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %v", err)
+		}
+		secret := strings.TrimRight(string(b), "\r\n")
+		if secret == "" {
+			return "", fmt.Errorf("secret file %s is empty", filename)
+		}
+		return secret, nil
+	}
+	return "", fmt.Errorf("secret must be in the form env:<VAR> or file:<path>")
+}
@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/lockfile"
+)
+
+const (
+	// Possible outcomes of a credential request
+	OutcomeAnonymous = "anonymous"
+	OutcomeError     = "error"
+	OutcomeNotFound  = "not_found"
+	OutcomeRefused   = "refused"
+	OutcomeSuccess   = "success"
+
+	// Rotation defaults
+	DefaultMaxSize    = 10 * 1024 * 1024
+	DefaultMaxBackups = 3
+
+	maxCmdlineLength = 1024
+	redacted         = "[REDACTED]"
+
+	lockSuffix  = ".lock"
+	lockTimeout = 5 * time.Second
+)
+
+type (
+	// Entry is a single credential request. It must never contain the secret itself.
+	Entry struct {
+		Timestamp     time.Time `json:"timestamp"`
+		ServerURL     string    `json:"server_url"`
+		Helper        string    `json:"helper,omitempty"`
+		Source        string    `json:"source,omitempty"`
+		ParentPID     int       `json:"parent_pid"`
+		ParentCmdline string    `json:"parent_cmdline,omitempty"`
+		Outcome       string    `json:"outcome"`
+		LatencyMs     int64     `json:"latency_ms"`
+	}
+
+	// Logger appends entries as JSON lines to a file, rotating it once it
+	// exceeds maxSize bytes and keeping up to maxBackups old files.
+	Logger struct {
+		filename   string
+		maxSize    int64
+		maxBackups int
+	}
+)
+
+// New returns a Logger for the given file. Non-positive values for
+// maxSize and maxBackups are replaced with the defaults.
+func New(filename string, maxSize int64, maxBackups int) *Logger {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = DefaultMaxBackups
+	}
+	return &Logger{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+}
+
+// NewEntry returns an entry for a request starting now, populated with
+// details about the calling (parent) process.
+func NewEntry(serverURL string) *Entry {
+	ppid := os.Getppid()
+	return &Entry{
+		Timestamp:     time.Now().UTC(),
+		ServerURL:     serverURL,
+		ParentPID:     ppid,
+		ParentCmdline: processCmdline(ppid),
+	}
+}
+
+// Finish sets the outcome and latency of the entry.
+func (e *Entry) Finish(outcome string) {
+	e.Outcome = outcome
+	e.LatencyMs = time.Since(e.Timestamp).Milliseconds()
+}
+
+// Write appends an entry to the log file. Concurrent writers (including
+// other processes) are serialized with a lock file next to the log file.
+func (l *Logger) Write(entry *Entry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding audit entry: %v", err)
+	}
+	b = append(b, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(l.filename), 0700); err != nil {
+		return fmt.Errorf("creating audit log directory: %v", err)
+	}
+	unlock, err := lockfile.Acquire(l.filename+lockSuffix, lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if info, err := os.Stat(l.filename); err == nil && info.Size()+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log '%s': %v", l.filename, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("writing audit log '%s': %v", l.filename, err)
+	}
+	return f.Close()
+}
+
+// Shift "log.1" -> "log.2" etc., dropping the oldest, then move "log" -> "log.1"
+func (l *Logger) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", l.filename, l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d", l.filename, i)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", l.filename, i+1)); err != nil {
+			return fmt.Errorf("rotating audit log '%s': %v", src, err)
+		}
+	}
+	if err := os.Rename(l.filename, fmt.Sprintf("%s.1", l.filename)); err != nil {
+		return fmt.Errorf("rotating audit log '%s': %v", l.filename, err)
+	}
+	return nil
+}
+
+// Best effort, only available on systems with procfs. Values of any password
+// flags (e.g. "docker login -p ...") are redacted, and the result truncated.
+func processCmdline(pid int) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	return redactCmdline(strings.Split(strings.TrimRight(string(b), "\x00"), "\x00"))
+}
+
+// Join command line args, redacting the values of any password flags and truncating the result.
+// Any arg starting with "-p" or "--password" may contain a password (e.g. "-phunter2"), and so
+// may the arg after a bare "-p" or "--password". Only "--password-stdin" is known to be safe.
+func redactCmdline(args []string) string {
+	redactedArgs := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case i > 0 && (args[i-1] == "-p" || args[i-1] == "--password"):
+			redactedArgs[i] = redacted
+		case arg == "-p" || arg == "--password" || arg == "--password-stdin":
+			redactedArgs[i] = arg
+		case strings.HasPrefix(arg, "--password="):
+			redactedArgs[i] = "--password=" + redacted
+		case strings.HasPrefix(arg, "--password"):
+			redactedArgs[i] = "--password" + redacted
+		case strings.HasPrefix(arg, "-p"):
+			redactedArgs[i] = "-p" + redacted
+		default:
+			redactedArgs[i] = arg
+		}
+	}
+	cmdline := strings.Join(redactedArgs, " ")
+	if len(cmdline) > maxCmdlineLength {
+		cmdline = cmdline[:maxCmdlineLength]
+	}
+	return cmdline
+}
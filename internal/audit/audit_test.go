@@ -0,0 +1,172 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditTestSuite struct {
+	suite.Suite
+	RootDir string
+}
+
+func (suite *AuditTestSuite) SetupSuite() {
+	rootDir, err := ioutil.TempDir("", "audit-test")
+	suite.Nil(err, "creating root dir")
+	suite.RootDir = rootDir
+}
+
+func (suite *AuditTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.RootDir)
+}
+
+// Read the entries in a log file
+func (suite *AuditTestSuite) readEntries(filename string) []Entry {
+	f, err := os.Open(filename)
+	suite.Nil(err, fmt.Sprintf("opening %s", filename))
+	defer f.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		suite.Nil(err, fmt.Sprintf("invalid line in %s: %s", filename, scanner.Text()))
+		entries = append(entries, entry)
+	}
+	suite.Nil(scanner.Err(), fmt.Sprintf("reading %s", filename))
+	return entries
+}
+
+func (suite *AuditTestSuite) Test_0_Write() {
+	filename := filepath.Join(suite.RootDir, "test0", "audit.log")
+	logger := New(filename, 0, 0)
+	suite.Equal(int64(DefaultMaxSize), logger.maxSize)
+	suite.Equal(DefaultMaxBackups, logger.maxBackups)
+
+	entry := NewEntry("registry.example.com")
+	suite.Equal(os.Getppid(), entry.ParentPID)
+	entry.Helper = "example"
+	entry.Finish(OutcomeSuccess)
+	err := logger.Write(entry)
+	suite.Nil(err, "test0 writing entry")
+	err = logger.Write(entry)
+	suite.Nil(err, "test0 writing entry again")
+
+	entries := suite.readEntries(filename)
+	suite.Len(entries, 2)
+	suite.Equal("registry.example.com", entries[0].ServerURL)
+	suite.Equal("example", entries[0].Helper)
+	suite.Equal(OutcomeSuccess, entries[0].Outcome)
+	suite.NoFileExists(filename + lockSuffix)
+	info, err := os.Stat(filename)
+	suite.Nil(err, "test0 stat log file")
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func (suite *AuditTestSuite) Test_1_Rotate() {
+	filename := filepath.Join(suite.RootDir, "test1", "audit.log")
+	entry := NewEntry("registry.example.com")
+	entry.Finish(OutcomeAnonymous)
+	b, err := json.Marshal(entry)
+	suite.Nil(err, "test1 encoding entry")
+
+	// Room for 3 entries per file, keeping 2 old files
+	logger := New(filename, int64(3*(len(b)+1)), 2)
+	for i := 0; i < 10; i++ {
+		err := logger.Write(entry)
+		suite.Nil(err, "test1 writing entry")
+	}
+	suite.Len(suite.readEntries(filename), 1)
+	suite.Len(suite.readEntries(filename+".1"), 3)
+	suite.Len(suite.readEntries(filename+".2"), 3)
+	suite.NoFileExists(filename + ".3")
+}
+
+func (suite *AuditTestSuite) Test_2_Concurrent() {
+	filename := filepath.Join(suite.RootDir, "test2", "audit.log")
+	logger := New(filename, 0, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				entry := NewEntry(fmt.Sprintf("registry%d.example.com", i))
+				entry.Finish(OutcomeSuccess)
+				suite.Nil(logger.Write(entry), "test2 writing entry")
+			}
+		}(i)
+	}
+	wg.Wait()
+	entries := suite.readEntries(filename)
+	suite.Len(entries, 200)
+	counts := map[string]int{}
+	for _, entry := range entries {
+		counts[entry.ServerURL]++
+	}
+	suite.Len(counts, 20)
+	for serverURL, count := range counts {
+		suite.Equal(10, count, serverURL)
+	}
+}
+
+func (suite *AuditTestSuite) Test_3_RedactCmdline() {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"docker", "pull", "alpine"}, "docker pull alpine"},
+		{[]string{"docker", "login", "-u", "me", "-p", "hunter2"}, "docker login -u me -p [REDACTED]"},
+		{[]string{"docker", "login", "--password", "hunter2", "r.io"}, "docker login --password [REDACTED] r.io"},
+		{[]string{"docker", "login", "--password=hunter2"}, "docker login --password=[REDACTED]"},
+		{[]string{"docker", "login", "-p"}, "docker login -p"},
+		{[]string{"docker", "login", "-phunter2"}, "docker login -p[REDACTED]"},
+		{[]string{"docker", "login", "-p=hunter2"}, "docker login -p[REDACTED]"},
+		{[]string{"docker", "login", "--passwordhunter2"}, "docker login --password[REDACTED]"},
+		{[]string{"docker", "login", "--password-stdin", "r.io"}, "docker login --password-stdin r.io"},
+		{[]string{"docker", "login", "-p", "-p", "hunter2"}, "docker login -p [REDACTED] [REDACTED]"},
+		{[]string{"docker", "login", "--password", "-phunter2"}, "docker login --password [REDACTED]"},
+	} {
+		suite.Equal(tc.expected, redactCmdline(tc.args))
+	}
+	long := redactCmdline([]string{"docker", strings.Repeat("x", 2*maxCmdlineLength)})
+	suite.Len(long, maxCmdlineLength)
+}
+
+func (suite *AuditTestSuite) Test_4_NeverRecordsSecret() {
+	// Entries have no field which could hold a secret
+	fields := map[string]bool{}
+	entryType := reflect.TypeOf(Entry{})
+	for i := 0; i < entryType.NumField(); i++ {
+		fields[entryType.Field(i).Name] = true
+	}
+	suite.Equal(map[string]bool{
+		"Timestamp": true, "ServerURL": true, "Helper": true, "Source": true,
+		"ParentPID": true, "ParentCmdline": true, "Outcome": true, "LatencyMs": true,
+	}, fields, "Entry fields changed, make sure none of them can contain a secret")
+
+	// A password on the command line of the caller does not end up in the log
+	filename := filepath.Join(suite.RootDir, "test4", "audit.log")
+	entry := NewEntry("registry.example.com")
+	entry.ParentCmdline = redactCmdline([]string{"docker", "login", "-p", "hunter2", "-phunter2", "registry.example.com"})
+	entry.Finish(OutcomeSuccess)
+	err := New(filename, 0, 0).Write(entry)
+	suite.Nil(err, "test4 writing entry")
+	b, err := ioutil.ReadFile(filename)
+	suite.Nil(err, "test4 reading log file")
+	suite.NotContains(string(b), "hunter2")
+}
+
+func TestAuditTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditTestSuite))
+}
@@ -1,21 +1,66 @@
 package constants
 
 const (
-	AnonymousTokenResponse            = "{\"Username\":\"\",\"Secret\":\"\"}\n"
-	BinariesSubdir                    = "bin"
-	DockerConfigFileBasename          = "config.json"
-	DockerConfigFileContents          = "{\"credsStore\":\"magic\"}\n"
-	DockerCredentialPrefix            = "docker-credential"
-	DockerHomeDir                     = ".docker"
-	EmbeddedParentDir                 = "embedded"
-	EnvVarDockerConfig                = "DOCKER_CONFIG"
-	EnvVarDockerCredentialMagicConfig = "DOCKER_CREDENTIAL_MAGIC_CONFIG"
-	EnvVarDockerOrigConfig            = "DOCKER_ORIG_CONFIG"
-	EnvVarPath                        = "PATH"
-	ExtensionYAML                     = "yml"
-	HelperSubcommandGet               = "get"
-	MagicCredentialSuffix             = "magic"
-	MagicRootDir                      = "/opt/magic"
-	MappingsSubdir                    = "etc"
-	XDGConfigSubdir                   = "magic"
+	AnnotationBaseDigest                       = "org.opencontainers.image.base.digest"
+	AnnotationBaseName                         = "org.opencontainers.image.base.name"
+	AnnotationCosignSignature                  = "dev.cosignproject.cosign/signature"
+	AnnotationHelpers                          = "com.github.docker-credential-magic.image.helpers"
+	AnnotationOrigBaseDigest                   = "com.github.docker-credential-magic.image.orig-base-digest"
+	AnnotationOrigBaseName                     = "com.github.docker-credential-magic.image.orig-base-name"
+	AnnotationPredicateType                    = "predicateType"
+	AnnotationVersion                          = "com.github.docker-credential-magic.image.version"
+	AnonymousTokenResponse                     = "{\"Username\":\"\",\"Secret\":\"\"}\n"
+	BinariesSubdir                             = "bin"
+	CredentialsNotFoundMessage                 = "credentials not found in native keychain"
+	DSSEMediaType                              = "application/vnd.dsse.envelope.v1+json"
+	DockerConfigFileBasename                   = "config.json"
+	DockerConfigFileContents                   = "{\"credsStore\":\"magic\"}\n"
+	DockerCredentialPrefix                     = "docker-credential"
+	DockerHomeDir                              = ".docker"
+	EmbeddedParentDir                          = "embedded"
+	EnvVarDockerConfig                         = "DOCKER_CONFIG"
+	EnvVarDockerCredentialMagicChain           = "DOCKER_CREDENTIAL_MAGIC_CHAIN"
+	EnvVarDockerCredentialMagicConfig          = "DOCKER_CREDENTIAL_MAGIC_CONFIG"
+	EnvVarDockerCredentialMagicDepth           = "DOCKER_CREDENTIAL_MAGIC_DEPTH"
+	EnvVarDockerCredentialMagicStoreKey        = "DOCKER_CREDENTIAL_MAGIC_STORE_KEY"
+	EnvVarDockerCredentialMagicStoreKeyFile    = "DOCKER_CREDENTIAL_MAGIC_STORE_KEY_FILE"
+	EnvVarDockerCredentialMagicStorePassphrase = "DOCKER_CREDENTIAL_MAGIC_STORE_PASSPHRASE"
+	EnvVarDockerOrigConfig                     = "DOCKER_ORIG_CONFIG"
+	EnvVarPath                                 = "PATH"
+	ExtensionYAML                              = "yml"
+	HelperSubcommandErase                      = "erase"
+	HelperSubcommandGet                        = "get"
+	HelperSubcommandList                       = "list"
+	HelperSubcommandStore                      = "store"
+	IdentityTokenUsername                      = "<token>"
+	InTotoPayloadType                          = "application/vnd.in-toto+json"
+	InTotoStatementType                        = "https://in-toto.io/Statement/v0.1"
+	LabelHelpers                               = "com.github.docker-credential-magic.helpers"
+	LabelSource                                = "com.github.docker-credential-magic.source"
+	LabelSourceDigest                          = "com.github.docker-credential-magic.source-digest"
+	LabelVersion                               = "com.github.docker-credential-magic.version"
+	MagicCredentialSuffix                      = "magic"
+	MagicLayerComment                          = "docker-credential-magic layer"
+	MagicLicense                               = "Apache-2.0"
+	MagicMutateBuildType                       = "https://github.com/docker-credential-magic/docker-credential-magic/mutate@v1"
+	MagicRootDir                               = "/opt/magic"
+	MagicURL                                   = "https://github.com/docker-credential-magic/docker-credential-magic"
+	MagicianName                               = "docker-credential-magician"
+	MappingsSubdir                             = "etc"
+	OCIEmptyJSON                               = "{}"
+	OCIEmptyMediaType                          = "application/vnd.oci.empty.v1+json"
+	PolicyFileBasename                         = "policy.yml"
+	ProvenancePredicateType                    = "https://slsa.dev/provenance/v0.2"
+	SBOMMediaType                              = "text/spdx+json"
+	SettingsFileBasename                       = "magic.yml"
+	SignatureTagSuffix                         = ".sig"
+	SimpleSigningMediaType                     = "application/vnd.dev.cosign.simplesigning.v1+json"
+	SimpleSigningType                          = "cosign container image signature"
+	StoreFileBasename                          = "credentials.enc"
+	StoreHelper                                = "magic-store"
+	XDGConfigSubdir                            = "magic"
 )
+
+// MaxInvocationDepth is the maximum number of nested magic invocations
+// (e.g. via a helper which itself calls Docker) before magic gives up.
+const MaxInvocationDepth = 4
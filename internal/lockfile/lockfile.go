@@ -0,0 +1,139 @@
+package lockfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retryInterval = 10 * time.Millisecond
+
+	// Locks without a PID (i.e. left partially written) older than this are broken
+	staleTime = 30 * time.Second
+)
+
+// Acquire creates an exclusive lock file, waiting up to timeout for other holders
+// (including other processes) to release it, and returns a function to release it.
+//
+// The lock file contains the PID of its holder and a random token. A lock left behind
+// by a process which is no longer running is broken by atomically renaming it aside and
+// checking that it was the stale lock that was moved. If not (another waiter broke it
+// first, and a third acquired it), the lock is put back rather than deleted.
+func Acquire(filename string, timeout time.Duration) (func(), error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, werr := f.WriteString(token)
+			if cerr := f.Close(); werr == nil {
+				werr = cerr
+			}
+			if werr != nil {
+				os.Remove(filename)
+				return nil, fmt.Errorf("writing lock file '%s': %v", filename, werr)
+			}
+			return func() { release(filename, token) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("creating lock file '%s': %v", filename, err)
+		}
+		if holder, ok := readStale(filename); ok {
+			breakStale(filename, holder, token)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock file '%s'", filename)
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// "<pid>:<random hex>", unique to each acquisition
+func newToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating lock token: %v", err)
+	}
+	return fmt.Sprintf("%d:%s", os.Getpid(), hex.EncodeToString(b)), nil
+}
+
+// Read the token of the current holder, if its lock is stale
+func readStale(filename string) (string, bool) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", false
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", false
+	}
+	holder := string(b)
+	pid, err := strconv.Atoi(strings.SplitN(holder, ":", 2)[0])
+	if err != nil || pid <= 0 {
+		// An empty (or partial) token may be a lock which is still being written
+		return holder, time.Since(info.ModTime()) > staleTime
+	}
+	return holder, !processExists(pid)
+}
+
+// Move the stale lock aside (to a file named after the token of the waiter breaking it),
+// and delete it only if it is the stale lock. Otherwise another waiter broke it first
+// and a new holder has since acquired it, so it is put back.
+func breakStale(filename string, holder string, token string) {
+	aside := fmt.Sprintf("%s.stale-%s", filename, strings.Replace(token, ":", "-", 1))
+	if err := os.Rename(filename, aside); err != nil {
+		return
+	}
+	if b, err := ioutil.ReadFile(aside); err == nil && string(b) == holder {
+		os.Remove(aside)
+		return
+	}
+	restore(filename, aside)
+}
+
+// Put a lock moved aside back, waiting for any lock created meanwhile to be released.
+// Link fails (leaving things as they are) while another lock exists, and once the lock
+// moved aside has been released by its holder (see release).
+func restore(filename string, aside string) {
+	for {
+		err := os.Link(aside, filename)
+		if err == nil {
+			os.Remove(aside)
+			return
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// Remove the lock file, unless it was broken and now belongs to someone else, and
+// any copy of it moved aside by a waiter which is waiting to put it back
+func release(filename string, token string) {
+	if b, err := ioutil.ReadFile(filename); err == nil && string(b) == token {
+		os.Remove(filename)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filename))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), filepath.Base(filename)+".stale-") {
+			continue
+		}
+		aside := filepath.Join(filepath.Dir(filename), entry.Name())
+		if b, err := ioutil.ReadFile(aside); err == nil && string(b) == token {
+			os.Remove(aside)
+		}
+	}
+}
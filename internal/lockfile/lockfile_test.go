@@ -0,0 +1,173 @@
+package lockfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LockfileTestSuite struct {
+	suite.Suite
+	RootDir string
+}
+
+func (suite *LockfileTestSuite) SetupSuite() {
+	rootDir, err := ioutil.TempDir("", "lockfile-test")
+	suite.Nil(err, "creating root dir")
+	suite.RootDir = rootDir
+}
+
+func (suite *LockfileTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.RootDir)
+}
+
+func (suite *LockfileTestSuite) Test_0_AcquireRelease() {
+	filename := filepath.Join(suite.RootDir, "test0.lock")
+	unlock, err := Acquire(filename, time.Second)
+	suite.Nil(err, "test0 acquiring lock")
+	b, err := ioutil.ReadFile(filename)
+	suite.Nil(err, "test0 reading lock file")
+	suite.Regexp(fmt.Sprintf("^%d:[0-9a-f]+$", os.Getpid()), string(b))
+
+	// Held by a running process (us), so not stale
+	_, err = Acquire(filename, 50*time.Millisecond)
+	suite.NotNil(err, "test0 acquired lock while held")
+
+	unlock()
+	suite.NoFileExists(filename)
+	unlock, err = Acquire(filename, time.Second)
+	suite.Nil(err, "test0 acquiring released lock")
+	unlock()
+}
+
+func (suite *LockfileTestSuite) Test_1_BreakStale() {
+	// Lock held by a process which has exited
+	filename := filepath.Join(suite.RootDir, "test1.lock")
+	cmd := exec.Command("true")
+	err := cmd.Run()
+	suite.Nil(err, "test1 running process")
+	err = ioutil.WriteFile(filename, []byte(fmt.Sprintf("%d:deadbeef", cmd.Process.Pid)), 0600)
+	suite.Nil(err, "test1 writing lock file")
+	unlock, err := Acquire(filename, time.Second)
+	suite.Nil(err, "test1 lock of exited process not broken")
+	unlock()
+
+	// Old lock of a running process (us) is left alone
+	err = ioutil.WriteFile(filename, []byte(fmt.Sprintf("%d:deadbeef", os.Getpid())), 0600)
+	suite.Nil(err, "test1 writing lock file")
+	old := time.Now().Add(-2 * staleTime)
+	err = os.Chtimes(filename, old, old)
+	suite.Nil(err, "test1 changing lock file time")
+	_, err = Acquire(filename, 50*time.Millisecond)
+	suite.NotNil(err, "test1 old lock of running process broken")
+
+	// Lock which is still being written (no PID yet) is left alone
+	err = ioutil.WriteFile(filename, nil, 0600)
+	suite.Nil(err, "test1 writing lock file")
+	_, err = Acquire(filename, 50*time.Millisecond)
+	suite.NotNil(err, "test1 new empty lock broken")
+
+	// Unless it is old
+	err = os.Chtimes(filename, old, old)
+	suite.Nil(err, "test1 changing lock file time")
+	unlock, err = Acquire(filename, time.Second)
+	suite.Nil(err, "test1 old empty lock not broken")
+	unlock()
+}
+
+func (suite *LockfileTestSuite) Test_2_BreakStaleRace() {
+	// Another waiter broke the stale lock first, and a new holder acquired it:
+	// breaking it again must leave the new lock in place
+	filename := filepath.Join(suite.RootDir, "test2.lock")
+	fresh := fmt.Sprintf("%d:cafebabe", os.Getpid())
+	err := ioutil.WriteFile(filename, []byte(fresh), 0600)
+	suite.Nil(err, "test2 writing lock file")
+	breakStale(filename, "12345:deadbeef", "67890:feedface")
+	b, err := ioutil.ReadFile(filename)
+	suite.Nil(err, "test2 fresh lock removed")
+	suite.Equal(fresh, string(b))
+	suite.NoFileExists(filename + ".stale-67890-feedface")
+
+	// Releasing a lock which now belongs to someone else leaves it in place
+	release(filename, "12345:deadbeef")
+	suite.FileExists(filename)
+	release(filename, fresh)
+	suite.NoFileExists(filename)
+
+	// Yet another lock was created while the fresh lock was aside: the fresh lock is
+	// kept aside (not deleted) until that is released, then put back
+	aside := filename + ".stale-67890-feedface"
+	other := fmt.Sprintf("%d:0badf00d", os.Getpid())
+	err = ioutil.WriteFile(aside, []byte(fresh), 0600)
+	suite.Nil(err, "test2 writing lock file moved aside")
+	err = ioutil.WriteFile(filename, []byte(other), 0600)
+	suite.Nil(err, "test2 writing other lock file")
+	done := make(chan struct{})
+	go func() {
+		restore(filename, aside)
+		close(done)
+	}()
+	time.Sleep(5 * retryInterval)
+	suite.FileExists(aside)
+	release(filename, other)
+	<-done
+	b, err = ioutil.ReadFile(filename)
+	suite.Nil(err, "test2 fresh lock not put back")
+	suite.Equal(fresh, string(b))
+	suite.NoFileExists(aside)
+
+	// Releasing a lock which is aside removes it, so it is not put back
+	err = os.Rename(filename, aside)
+	suite.Nil(err, "test2 moving lock file aside")
+	err = ioutil.WriteFile(filename, []byte(other), 0600)
+	suite.Nil(err, "test2 writing other lock file")
+	release(filename, fresh)
+	suite.NoFileExists(aside)
+	restore(filename, aside)
+	b, err = ioutil.ReadFile(filename)
+	suite.Nil(err, "test2 other lock removed")
+	suite.Equal(other, string(b))
+	release(filename, other)
+	suite.NoFileExists(filename)
+}
+
+func (suite *LockfileTestSuite) Test_3_Concurrent() {
+	// Non-atomic read-modify-write of a counter, serialized by the lock
+	filename := filepath.Join(suite.RootDir, "test3.lock")
+	counter := filepath.Join(suite.RootDir, "test3.count")
+	err := ioutil.WriteFile(counter, []byte("0"), 0600)
+	suite.Nil(err, "test3 writing counter")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				unlock, err := Acquire(filename, 10*time.Second)
+				if !suite.Nil(err, "test3 acquiring lock") {
+					return
+				}
+				b, _ := ioutil.ReadFile(counter)
+				n, _ := strconv.Atoi(string(b))
+				ioutil.WriteFile(counter, []byte(strconv.Itoa(n+1)), 0600)
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	b, err := ioutil.ReadFile(counter)
+	suite.Nil(err, "test3 reading counter")
+	suite.Equal("200", string(b))
+}
+
+func TestLockfileTestSuite(t *testing.T) {
+	suite.Run(t, new(LockfileTestSuite))
+}
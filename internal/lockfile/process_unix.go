@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package lockfile
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Signal 0 checks whether a process exists without affecting it
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
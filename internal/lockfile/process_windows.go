@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package lockfile
+
+import "os"
+
+// On windows, FindProcess fails if there is no process with this PID
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
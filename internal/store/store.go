@@ -0,0 +1,327 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+	"github.com/docker-credential-magic/docker-credential-magic/internal/lockfile"
+)
+
+const (
+	fileVersion = 1
+
+	kdfNone   = "none"
+	kdfScrypt = "scrypt"
+
+	keySize   = 32
+	nonceSize = 24
+	saltSize  = 16
+
+	// Recommended scrypt parameters for interactive logins (as of 2017)
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+
+	lockSuffix  = ".lock"
+	lockTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNotFound is returned when no credentials are stored for a server URL.
+	ErrNotFound = errors.New(constants.CredentialsNotFoundMessage)
+
+	// ErrNoKey is returned when none of the store key env vars are set.
+	ErrNoKey = fmt.Errorf("no store key configured (set one of %s, %s or %s)",
+		constants.EnvVarDockerCredentialMagicStoreKey,
+		constants.EnvVarDockerCredentialMagicStoreKeyFile,
+		constants.EnvVarDockerCredentialMagicStorePassphrase)
+)
+
+type (
+	// Credentials is a single entry in the store, using the same
+	// JSON field names as the Docker credential helper protocol.
+	Credentials struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}
+
+	// Key is used to encrypt and decrypt the store. It is either a raw
+	// 32-byte key, or a passphrase from which a key is derived via scrypt.
+	Key struct {
+		raw        *[keySize]byte
+		passphrase []byte
+	}
+
+	// FileStore is a credential store persisted to a single encrypted file.
+	FileStore struct {
+		filename string
+		key      *Key
+	}
+
+	// On-disk format of the store file. The plaintext is a JSON-encoded
+	// map of server URL to Credentials, sealed with NaCl secretbox.
+	envelope struct {
+		Version    int    `json:"version"`
+		KDF        string `json:"kdf"`
+		Salt       []byte `json:"salt,omitempty"`
+		Nonce      []byte `json:"nonce"`
+		Ciphertext []byte `json:"ciphertext"`
+	}
+)
+
+// KeyFromEnv loads the store key from the environment. In order of precedence:
+// a base64-encoded key, a file containing a base64-encoded key, or a passphrase.
+func KeyFromEnv() (*Key, error) {
+	if v := os.Getenv(constants.EnvVarDockerCredentialMagicStoreKey); v != "" {
+		return parseRawKey(v, constants.EnvVarDockerCredentialMagicStoreKey)
+	}
+	if filename := os.Getenv(constants.EnvVarDockerCredentialMagicStoreKeyFile); filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file '%s': %v", filename, err)
+		}
+		return parseRawKey(string(b), filename)
+	}
+	if v := os.Getenv(constants.EnvVarDockerCredentialMagicStorePassphrase); v != "" {
+		return &Key{passphrase: []byte(v)}, nil
+	}
+	return nil, ErrNoKey
+}
+
+func parseRawKey(s string, source string) (*Key, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key from %s: %v", source, err)
+	}
+	if len(b) != keySize {
+		return nil, fmt.Errorf("key from %s must be %d bytes, got %d", source, keySize, len(b))
+	}
+	var raw [keySize]byte
+	copy(raw[:], b)
+	return &Key{raw: &raw}, nil
+}
+
+// DefaultFilename returns the location of the store file within a magic config directory.
+func DefaultFilename(configDir string) string {
+	return filepath.Join(configDir, constants.StoreFileBasename)
+}
+
+// New returns a FileStore backed by the given file, which need not exist yet.
+func New(filename string, key *Key) *FileStore {
+	return &FileStore{
+		filename: filename,
+		key:      key,
+	}
+}
+
+// Exists returns whether the store file has been created.
+func (s *FileStore) Exists() bool {
+	info, err := os.Stat(s.filename)
+	return err == nil && !info.IsDir()
+}
+
+// Get returns the credentials stored for a server URL.
+func (s *FileStore) Get(serverURL string) (*Credentials, error) {
+	entries, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	creds, ok := entries[serverURL]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return creds, nil
+}
+
+// Store adds or replaces the credentials for a server URL.
+// Concurrent calls to Store and Erase (including from other processes) are serialized.
+func (s *FileStore) Store(creds *Credentials) error {
+	if creds.ServerURL == "" {
+		return errors.New("missing server url")
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, salt, err := s.load()
+	if err != nil {
+		return err
+	}
+	entries[creds.ServerURL] = creds
+	return s.save(entries, salt)
+}
+
+// Erase removes the credentials stored for a server URL.
+func (s *FileStore) Erase(serverURL string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, salt, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[serverURL]; !ok {
+		return ErrNotFound
+	}
+	delete(entries, serverURL)
+	return s.save(entries, salt)
+}
+
+// List returns a map of server URL to username for all stored credentials.
+func (s *FileStore) List() (map[string]string, error) {
+	entries, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	list := map[string]string{}
+	for serverURL, creds := range entries {
+		list[serverURL] = creds.Username
+	}
+	return list, nil
+}
+
+// Hold a lock file next to the store file, so concurrent changes (e.g. from two
+// "docker login" runs) are serialized rather than one overwriting the other
+func (s *FileStore) lock() (func(), error) {
+	dir := filepath.Dir(s.filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating directory '%s': %v", dir, err)
+	}
+	return lockfile.Acquire(s.filename+lockSuffix, lockTimeout)
+}
+
+// Load and decrypt the store file, returning the entries and the scrypt salt (if any).
+// A missing file is treated as an empty store.
+func (s *FileStore) load() (map[string]*Credentials, []byte, error) {
+	entries := map[string]*Credentials{}
+	b, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil, nil
+		}
+		return nil, nil, fmt.Errorf("reading store '%s': %v", s.filename, err)
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, nil, fmt.Errorf("parsing store '%s': %v", s.filename, err)
+	}
+	if env.Version != fileVersion {
+		return nil, nil, fmt.Errorf("store '%s' has unsupported version %d", s.filename, env.Version)
+	}
+	if len(env.Nonce) != nonceSize {
+		return nil, nil, fmt.Errorf("store '%s' has invalid nonce", s.filename)
+	}
+	key, err := s.key.derive(env.KDF, env.Salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("store '%s': %v", s.filename, err)
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], env.Nonce)
+	plaintext, ok := secretbox.Open(nil, env.Ciphertext, &nonce, key)
+	if !ok {
+		return nil, nil, fmt.Errorf("decrypting store '%s': wrong key or corrupted file", s.filename)
+	}
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, nil, fmt.Errorf("parsing decrypted store '%s': %v", s.filename, err)
+	}
+	return entries, env.Salt, nil
+}
+
+// Encrypt and atomically write the store file, reusing the existing salt if present.
+func (s *FileStore) save(entries map[string]*Credentials, salt []byte) error {
+	env := envelope{
+		Version: fileVersion,
+		KDF:     kdfNone,
+	}
+	if s.key.raw == nil {
+		env.KDF = kdfScrypt
+		if len(salt) == 0 {
+			salt = make([]byte, saltSize)
+			if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+				return fmt.Errorf("generating salt: %v", err)
+			}
+		}
+		env.Salt = salt
+	}
+	key, err := s.key.derive(env.KDF, env.Salt)
+	if err != nil {
+		return err
+	}
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return fmt.Errorf("generating nonce: %v", err)
+	}
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("encoding store: %v", err)
+	}
+	env.Nonce = nonce[:]
+	env.Ciphertext = secretbox.Seal(nil, plaintext, &nonce, key)
+	b, err := json.Marshal(&env)
+	if err != nil {
+		return fmt.Errorf("encoding store: %v", err)
+	}
+
+	dir := filepath.Dir(s.filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating directory '%s': %v", dir, err)
+	}
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf(".%s-*", filepath.Base(s.filename)))
+	if err != nil {
+		return fmt.Errorf("creating temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return fmt.Errorf("chmod temp file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.filename); err != nil {
+		return fmt.Errorf("writing store '%s': %v", s.filename, err)
+	}
+	return nil
+}
+
+func (k *Key) derive(kdf string, salt []byte) (*[keySize]byte, error) {
+	switch kdf {
+	case kdfNone:
+		if k.raw == nil {
+			return nil, errors.New("store was encrypted with a raw key, but a passphrase was supplied")
+		}
+		return k.raw, nil
+	case kdfScrypt:
+		if k.passphrase == nil {
+			return nil, errors.New("store was encrypted with a passphrase, but a raw key was supplied")
+		}
+		b, err := scrypt.Key(k.passphrase, salt, scryptN, scryptR, scryptP, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("deriving key: %v", err)
+		}
+		var key [keySize]byte
+		copy(key[:], b)
+		return &key, nil
+	}
+	return nil, fmt.Errorf("unsupported kdf '%s'", kdf)
+}
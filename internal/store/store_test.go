@@ -0,0 +1,292 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+type StoreTestSuite struct {
+	suite.Suite
+	RootDir string
+}
+
+func (suite *StoreTestSuite) SetupSuite() {
+	rootDir, err := ioutil.TempDir("", "store-test")
+	suite.Nil(err, "creating root dir")
+	suite.RootDir = rootDir
+}
+
+func (suite *StoreTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.RootDir)
+}
+
+// Generate a new random raw key
+func (suite *StoreTestSuite) newRawKey() *Key {
+	b := make([]byte, keySize)
+	_, err := rand.Read(b)
+	suite.Nil(err, "generating key")
+	key, err := parseRawKey(base64.StdEncoding.EncodeToString(b), "test")
+	suite.Nil(err, "parsing key")
+	return key
+}
+
+func (suite *StoreTestSuite) Test_0_RoundTrip() {
+	filename := filepath.Join(suite.RootDir, "test0", constants.StoreFileBasename)
+	s := New(filename, suite.newRawKey())
+	suite.False(s.Exists())
+	_, err := s.Get("registry.example.com")
+	suite.Equal(ErrNotFound, err)
+	list, err := s.List()
+	suite.Nil(err, "test0 listing empty store")
+	suite.Empty(list)
+
+	err = s.Store(&Credentials{ServerURL: "registry.example.com", Username: "me", Secret: "hunter2"})
+	suite.Nil(err, "test0 storing creds")
+	err = s.Store(&Credentials{ServerURL: "other.example.com", Username: "you", Secret: "swordfish"})
+	suite.Nil(err, "test0 storing other creds")
+	suite.True(s.Exists())
+	info, err := os.Stat(filename)
+	suite.Nil(err, "test0 stat store file")
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+	b, err := ioutil.ReadFile(filename)
+	suite.Nil(err, "test0 reading store file")
+	suite.NotContains(string(b), "hunter2")
+	suite.NoFileExists(filename + lockSuffix)
+
+	creds, err := s.Get("registry.example.com")
+	suite.Nil(err, "test0 getting creds")
+	suite.Equal(&Credentials{ServerURL: "registry.example.com", Username: "me", Secret: "hunter2"}, creds)
+	list, err = s.List()
+	suite.Nil(err, "test0 listing store")
+	suite.Equal(map[string]string{"registry.example.com": "me", "other.example.com": "you"}, list)
+
+	// Replace, then erase
+	err = s.Store(&Credentials{ServerURL: "registry.example.com", Username: "me", Secret: "correcthorse"})
+	suite.Nil(err, "test0 replacing creds")
+	creds, err = s.Get("registry.example.com")
+	suite.Nil(err, "test0 getting replaced creds")
+	suite.Equal("correcthorse", creds.Secret)
+	err = s.Erase("registry.example.com")
+	suite.Nil(err, "test0 erasing creds")
+	_, err = s.Get("registry.example.com")
+	suite.Equal(ErrNotFound, err)
+	list, err = s.List()
+	suite.Nil(err, "test0 listing store after erase")
+	suite.Equal(map[string]string{"other.example.com": "you"}, list)
+
+	err = s.Store(&Credentials{Username: "me"})
+	suite.NotNil(err, "test0 no error storing creds without server url")
+}
+
+func (suite *StoreTestSuite) Test_1_Passphrase() {
+	filename := filepath.Join(suite.RootDir, "test1", constants.StoreFileBasename)
+	s := New(filename, &Key{passphrase: []byte("open sesame")})
+	err := s.Store(&Credentials{ServerURL: "registry.example.com", Username: "me", Secret: "hunter2"})
+	suite.Nil(err, "test1 storing creds")
+	env := suite.readEnvelope(filename)
+	suite.Equal(kdfScrypt, env.KDF)
+	suite.Len(env.Salt, saltSize)
+
+	// Salt is kept, nonce is not
+	err = s.Store(&Credentials{ServerURL: "other.example.com", Username: "you", Secret: "swordfish"})
+	suite.Nil(err, "test1 storing other creds")
+	env2 := suite.readEnvelope(filename)
+	suite.Equal(env.Salt, env2.Salt)
+	suite.NotEqual(env.Nonce, env2.Nonce)
+
+	creds, err := New(filename, &Key{passphrase: []byte("open sesame")}).Get("registry.example.com")
+	suite.Nil(err, "test1 getting creds with same passphrase")
+	suite.Equal("hunter2", creds.Secret)
+}
+
+func (suite *StoreTestSuite) Test_2_WrongKey() {
+	filename := filepath.Join(suite.RootDir, "test2", constants.StoreFileBasename)
+	err := New(filename, suite.newRawKey()).Store(&Credentials{ServerURL: "registry.example.com", Secret: "hunter2"})
+	suite.Nil(err, "test2 storing creds")
+	s := New(filename, suite.newRawKey())
+	_, err = s.Get("registry.example.com")
+	suite.NotNil(err, "test2 no error getting creds with wrong key")
+	suite.NotEqual(ErrNotFound, err)
+	err = s.Store(&Credentials{ServerURL: "other.example.com", Secret: "swordfish"})
+	suite.NotNil(err, "test2 no error storing creds with wrong key")
+
+	filename = filepath.Join(suite.RootDir, "test2-passphrase", constants.StoreFileBasename)
+	err = New(filename, &Key{passphrase: []byte("open sesame")}).Store(&Credentials{ServerURL: "registry.example.com"})
+	suite.Nil(err, "test2 storing creds with passphrase")
+	_, err = New(filename, &Key{passphrase: []byte("open barley")}).Get("registry.example.com")
+	suite.NotNil(err, "test2 no error getting creds with wrong passphrase")
+}
+
+func (suite *StoreTestSuite) Test_3_KeyKindMismatch() {
+	filename := filepath.Join(suite.RootDir, "test3-raw", constants.StoreFileBasename)
+	err := New(filename, suite.newRawKey()).Store(&Credentials{ServerURL: "registry.example.com"})
+	suite.Nil(err, "test3 storing creds with raw key")
+	_, err = New(filename, &Key{passphrase: []byte("open sesame")}).Get("registry.example.com")
+	suite.NotNil(err, "test3 no error getting creds with passphrase")
+	suite.Contains(err.Error(), "encrypted with a raw key")
+
+	filename = filepath.Join(suite.RootDir, "test3-passphrase", constants.StoreFileBasename)
+	err = New(filename, &Key{passphrase: []byte("open sesame")}).Store(&Credentials{ServerURL: "registry.example.com"})
+	suite.Nil(err, "test3 storing creds with passphrase")
+	_, err = New(filename, suite.newRawKey()).Get("registry.example.com")
+	suite.NotNil(err, "test3 no error getting creds with raw key")
+	suite.Contains(err.Error(), "encrypted with a passphrase")
+}
+
+func (suite *StoreTestSuite) Test_4_Corrupted() {
+	filename := filepath.Join(suite.RootDir, "test4", constants.StoreFileBasename)
+	key := suite.newRawKey()
+	err := New(filename, key).Store(&Credentials{ServerURL: "registry.example.com", Secret: "hunter2"})
+	suite.Nil(err, "test4 storing creds")
+	good, err := ioutil.ReadFile(filename)
+	suite.Nil(err, "test4 reading store file")
+	env := suite.readEnvelope(filename)
+
+	flipped := env
+	flipped.Ciphertext = append([]byte{}, env.Ciphertext...)
+	flipped.Ciphertext[len(flipped.Ciphertext)/2] ^= 0xff
+	shortCiphertext := env
+	shortCiphertext.Ciphertext = env.Ciphertext[:len(env.Ciphertext)-1]
+	badNonce := env
+	badNonce.Nonce = env.Nonce[:nonceSize-1]
+	badVersion := env
+	badVersion.Version = fileVersion + 1
+	badKDF := env
+	badKDF.KDF = "rot13"
+	for name, b := range map[string][]byte{
+		"flipped byte":     suite.encodeEnvelope(flipped),
+		"short ciphertext": suite.encodeEnvelope(shortCiphertext),
+		"bad nonce":        suite.encodeEnvelope(badNonce),
+		"bad version":      suite.encodeEnvelope(badVersion),
+		"bad kdf":          suite.encodeEnvelope(badKDF),
+		"truncated file":   good[:len(good)/2],
+		"empty file":       {},
+		"not a store file": []byte("hello"),
+	} {
+		err := ioutil.WriteFile(filename, b, 0600)
+		suite.Nil(err, fmt.Sprintf("test4 writing store file (%s)", name))
+		_, err = New(filename, key).Get("registry.example.com")
+		suite.NotNil(err, fmt.Sprintf("test4 no error getting creds (%s)", name))
+		suite.NotEqual(ErrNotFound, err, name)
+		err = New(filename, key).Store(&Credentials{ServerURL: "other.example.com"})
+		suite.NotNil(err, fmt.Sprintf("test4 no error storing creds (%s)", name))
+	}
+}
+
+func (suite *StoreTestSuite) Test_5_EraseMissing() {
+	filename := filepath.Join(suite.RootDir, "test5", constants.StoreFileBasename)
+	s := New(filename, suite.newRawKey())
+	err := s.Erase("registry.example.com")
+	suite.Equal(ErrNotFound, err, "test5 erasing from missing store")
+	suite.False(s.Exists())
+
+	err = s.Store(&Credentials{ServerURL: "other.example.com"})
+	suite.Nil(err, "test5 storing creds")
+	err = s.Erase("registry.example.com")
+	suite.Equal(ErrNotFound, err, "test5 erasing missing entry")
+	list, err := s.List()
+	suite.Nil(err, "test5 listing store")
+	suite.Equal(map[string]string{"other.example.com": ""}, list)
+}
+
+func (suite *StoreTestSuite) Test_6_Concurrent() {
+	// Separate stores for the same file, as with separate "docker login" processes
+	filename := filepath.Join(suite.RootDir, "test6", constants.StoreFileBasename)
+	key := suite.newRawKey()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serverURL := fmt.Sprintf("registry%d.example.com", i)
+			err := New(filename, key).Store(&Credentials{ServerURL: serverURL, Username: "me"})
+			suite.Nil(err, fmt.Sprintf("test6 storing creds for %s", serverURL))
+		}(i)
+	}
+	wg.Wait()
+	list, err := New(filename, key).List()
+	suite.Nil(err, "test6 listing store")
+	suite.Len(list, 20)
+
+	for i := 0; i < 20; i += 2 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serverURL := fmt.Sprintf("registry%d.example.com", i)
+			err := New(filename, key).Erase(serverURL)
+			suite.Nil(err, fmt.Sprintf("test6 erasing creds for %s", serverURL))
+		}(i)
+	}
+	wg.Wait()
+	list, err = New(filename, key).List()
+	suite.Nil(err, "test6 listing store")
+	suite.Len(list, 10)
+}
+
+func (suite *StoreTestSuite) Test_7_KeyFromEnv() {
+	for _, key := range []string{
+		constants.EnvVarDockerCredentialMagicStoreKey,
+		constants.EnvVarDockerCredentialMagicStoreKeyFile,
+		constants.EnvVarDockerCredentialMagicStorePassphrase,
+	} {
+		if v, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, v)
+		} else {
+			defer os.Unsetenv(key)
+		}
+		os.Unsetenv(key)
+	}
+	_, err := KeyFromEnv()
+	suite.Equal(ErrNoKey, err)
+
+	os.Setenv(constants.EnvVarDockerCredentialMagicStorePassphrase, "open sesame")
+	key, err := KeyFromEnv()
+	suite.Nil(err, "test7 passphrase")
+	suite.Equal([]byte("open sesame"), key.passphrase)
+
+	raw := base64.StdEncoding.EncodeToString(make([]byte, keySize))
+	keyFile := filepath.Join(suite.RootDir, "test7.key")
+	err = ioutil.WriteFile(keyFile, []byte(raw+"\n"), 0600)
+	suite.Nil(err, "test7 writing key file")
+	os.Setenv(constants.EnvVarDockerCredentialMagicStoreKeyFile, keyFile)
+	key, err = KeyFromEnv()
+	suite.Nil(err, "test7 key file")
+	suite.NotNil(key.raw)
+
+	os.Setenv(constants.EnvVarDockerCredentialMagicStoreKey, base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	_, err = KeyFromEnv()
+	suite.NotNil(err, "test7 no error with short key")
+	os.Setenv(constants.EnvVarDockerCredentialMagicStoreKey, "not base64!")
+	_, err = KeyFromEnv()
+	suite.NotNil(err, "test7 no error with invalid key")
+}
+
+func (suite *StoreTestSuite) readEnvelope(filename string) envelope {
+	b, err := ioutil.ReadFile(filename)
+	suite.Nil(err, fmt.Sprintf("reading %s", filename))
+	var env envelope
+	err = json.Unmarshal(b, &env)
+	suite.Nil(err, fmt.Sprintf("parsing %s", filename))
+	return env
+}
+
+func (suite *StoreTestSuite) encodeEnvelope(env envelope) []byte {
+	b, err := json.Marshal(&env)
+	suite.Nil(err, "encoding envelope")
+	return b
+}
+
+func TestStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(StoreTestSuite))
+}
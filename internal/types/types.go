@@ -1,6 +0,0 @@
-package types
-
-type HelperMapping struct {
-	Helper  string
-	Domains []string
-}
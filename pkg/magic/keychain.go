@@ -0,0 +1,58 @@
+package magic
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// Keychain is an authn.Keychain which resolves credentials for each registry
+// through a Resolver, i.e. via magic's mappings, helpers, store and fallbacks.
+//
+// Registries for which there are no credentials (including those refused by
+// the policy file) resolve to authn.Anonymous, so a Keychain may be combined
+// with others using authn.NewMultiKeychain. Any other failure to get credentials
+// (e.g. a helper which is not installed or fails its checksum) is returned.
+type Keychain struct {
+	resolver *Resolver
+}
+
+// NewKeychain returns a Keychain backed by a new Resolver created with the given options.
+func NewKeychain(options ...ResolverOption) (*Keychain, error) {
+	resolver, err := NewResolver(options...)
+	if err != nil {
+		return nil, err
+	}
+	return KeychainFromResolver(resolver), nil
+}
+
+// KeychainFromResolver returns a Keychain backed by an existing Resolver.
+func KeychainFromResolver(resolver *Resolver) *Keychain {
+	return &Keychain{resolver: resolver}
+}
+
+// Resolve implements authn.Keychain.
+func (keychain *Keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	// Docker Hub credentials are stored under the legacy v1 URL (see authn.DefaultKeychain)
+	serverURL := target.RegistryStr()
+	if serverURL == name.DefaultRegistry {
+		serverURL = authn.DefaultAuthKey
+	}
+	creds, err := keychain.resolver.Get(serverURL)
+	if err == ErrCredentialsNotFound {
+		return authn.Anonymous, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials for %s: %v", serverURL, err)
+	}
+	if creds.IsAnonymous() {
+		return authn.Anonymous, nil
+	}
+	if creds.Username == constants.IdentityTokenUsername {
+		return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Secret}), nil
+}
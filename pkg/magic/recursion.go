@@ -0,0 +1,57 @@
+package magic
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// Nested invocations of magic (e.g. via a helper or fallback which calls back
+// into Docker), inherited from the environment when the Resolver was created
+type recursionState struct {
+	depth int
+	chain []string
+}
+
+func loadRecursionState() (*recursionState, error) {
+	state := &recursionState{}
+	if v := os.Getenv(constants.EnvVarDockerCredentialMagicDepth); v != "" {
+		var err error
+		state.depth, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", constants.EnvVarDockerCredentialMagicDepth, v)
+		}
+	}
+	if v := os.Getenv(constants.EnvVarDockerCredentialMagicChain); v != "" {
+		state.chain = strings.Split(v, ",")
+	}
+	return state, nil
+}
+
+// RecursionEnv detects nested invocations of magic for the same registry, or nesting
+// beyond a fixed depth. Otherwise it returns the environment variables ("KEY=value")
+// with the updated depth and chain of registries, to be set for any child process
+// which gets credentials for the server URL. Helpers executed by the Resolver are
+// always run with these set.
+func (resolver *Resolver) RecursionEnv(serverURL string) ([]string, error) {
+	host := RegistryHost(serverURL)
+	for _, h := range resolver.recursion.chain {
+		if h == host {
+			return nil, fmt.Errorf("recursion detected: %s -> %s",
+				strings.Join(resolver.recursion.chain, " -> "), host)
+		}
+	}
+	chain := append(append([]string{}, resolver.recursion.chain...), host)
+	depth := resolver.recursion.depth + 1
+	if depth > constants.MaxInvocationDepth {
+		return nil, fmt.Errorf("recursion detected: exceeded maximum depth of %d nested invocations (%s)",
+			constants.MaxInvocationDepth, strings.Join(chain, " -> "))
+	}
+	return []string{
+		fmt.Sprintf("%s=%d", constants.EnvVarDockerCredentialMagicDepth, depth),
+		fmt.Sprintf("%s=%s", constants.EnvVarDockerCredentialMagicChain, strings.Join(chain, ",")),
+	}, nil
+}
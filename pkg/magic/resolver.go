@@ -0,0 +1,673 @@
+package magic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/adrg/xdg"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/docker/pkg/homedir"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"gopkg.in/yaml.v2"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+	"github.com/docker-credential-magic/docker-credential-magic/internal/store"
+)
+
+const (
+	// SourceKindMapping means a mappings file matched the server URL.
+	SourceKindMapping SourceKind = "mapping"
+	// SourceKindStore means credentials were found in the encrypted store.
+	SourceKindStore SourceKind = "store"
+	// SourceKindFallback means credentials come from the fallback Docker config.
+	SourceKindFallback SourceKind = "fallback"
+	// SourceKindAnonymous means there is nowhere to get credentials from.
+	SourceKindAnonymous SourceKind = "anonymous"
+	// SourceKindRefused means the policy file refuses credentials for the server URL.
+	SourceKindRefused SourceKind = "refused"
+)
+
+var (
+	// ErrCredentialsNotFound is returned when a source has no credentials for a server URL.
+	ErrCredentialsNotFound = errors.New(constants.CredentialsNotFoundMessage)
+
+	errorInvalidDomain  = errors.New("supplied domain is invalid")
+	errorHelperNotFound = errors.New("could not determine correct helper")
+
+	validHelper = regexp.MustCompile(`^[a-z0-9_-].*?$`)
+)
+
+type (
+	// ResolverOption allows setting various configuration settings on a Resolver.
+	ResolverOption func(*Resolver)
+
+	// Resolver resolves a server URL to a source of credentials (a helper via
+	// mappings, the encrypted store, or a fallback Docker config), and gets
+	// credentials from that source, exactly as docker-credential-magic does.
+	Resolver struct {
+		configDir   string
+		mappingsDir string
+		mappingsFS  fs.FS
+		fallbackDir string
+		writer      io.Writer
+
+		settings  *Settings
+		policy    *Policy
+		recursion *recursionState
+
+		mappingsOnce sync.Once
+		mappings     []*loadedMapping
+		mappingsErr  error
+	}
+
+	// SourceKind describes the type of a Source.
+	SourceKind string
+
+	// Source describes where the credentials for a server URL come from.
+	Source struct {
+		ServerURL string
+		Kind      SourceKind
+
+		// The matching mapping (for SourceKindMapping)
+		Mapping *HelperMapping
+
+		// The mappings file, store file, or fallback Docker config directory
+		Filename string
+
+		// Why credentials were refused (for SourceKindRefused)
+		Reason string
+
+		storedCreds    *Credentials
+		fallbackConfig *configfile.ConfigFile
+	}
+
+	loadedMapping struct {
+		mapping  *HelperMapping
+		filename string
+	}
+
+	// Response to "get" from a downstream helper. IdentityToken is not part of the
+	// protocol, but is accepted from helpers which set it instead of "<token>".
+	helperResponse struct {
+		ServerURL     string
+		Username      *string
+		Secret        *string
+		IdentityToken string
+	}
+)
+
+// ResolverOptWithConfigDir sets the magic config directory, containing the etc/ mappings
+// directory, magic.yml and policy.yml (defaults to the result of DefaultConfigDir).
+func ResolverOptWithConfigDir(configDir string) ResolverOption {
+	return func(resolver *Resolver) {
+		resolver.configDir = configDir
+	}
+}
+
+// ResolverOptWithMappingsDir sets a custom directory to load mappings files from.
+func ResolverOptWithMappingsDir(mappingsDir string) ResolverOption {
+	return func(resolver *Resolver) {
+		resolver.mappingsDir = mappingsDir
+		resolver.mappingsFS = nil
+	}
+}
+
+// ResolverOptWithMappingsFS sets a custom filesystem to load mappings files from
+// (all files at its root are loaded).
+func ResolverOptWithMappingsFS(mappingsFS fs.FS) ResolverOption {
+	return func(resolver *Resolver) {
+		resolver.mappingsFS = mappingsFS
+		resolver.mappingsDir = ""
+	}
+}
+
+// ResolverOptWithFallbackConfigDir sets the Docker config directory to fall back to if
+// no mapping matches (defaults to $DOCKER_ORIG_CONFIG, or ~/.docker if it has a config.json).
+func ResolverOptWithFallbackConfigDir(fallbackDir string) ResolverOption {
+	return func(resolver *Resolver) {
+		resolver.fallbackDir = fallbackDir
+	}
+}
+
+// ResolverOptWithWriter sets an output writer for diagnostics (including helper stderr).
+func ResolverOptWithWriter(writer io.Writer) ResolverOption {
+	return func(resolver *Resolver) {
+		resolver.writer = writer
+	}
+}
+
+// DefaultConfigDir returns $DOCKER_CREDENTIAL_MAGIC_CONFIG if set,
+// otherwise the "magic" directory under $XDG_CONFIG_HOME.
+func DefaultConfigDir() string {
+	if d := os.Getenv(constants.EnvVarDockerCredentialMagicConfig); d != "" {
+		return d
+	}
+	return filepath.Join(xdg.ConfigHome, constants.XDGConfigSubdir)
+}
+
+// LoadSettings loads the settings file from a magic config directory, if present.
+func LoadSettings(configDir string) (*Settings, error) {
+	var settings Settings
+	filename := filepath.Join(configDir, constants.SettingsFileBasename)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &settings, nil
+		}
+		return nil, fmt.Errorf("unable to open '%s': %v", filename, err)
+	}
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return nil, fmt.Errorf("parsing settings '%s': %v", filename, err)
+	}
+	return &settings, nil
+}
+
+// LoadPolicy loads the policy file from a magic config directory, if present.
+func LoadPolicy(configDir string) (*Policy, error) {
+	var policy Policy
+	filename := filepath.Join(configDir, constants.PolicyFileBasename)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &policy, nil
+		}
+		return nil, fmt.Errorf("unable to open '%s': %v", filename, err)
+	}
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("parsing policy '%s': %v", filename, err)
+	}
+	for _, patterns := range [][]string{policy.Allow, policy.Deny} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern \"%s\" in policy '%s': %v",
+					pattern, filename, err)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// RegistryHost strips any scheme, path and default port from a server URL,
+// e.g. "https://index.docker.io/v1/" becomes "index.docker.io".
+func RegistryHost(serverURL string) string {
+	host := serverURL
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(host, ":443"), ":80")
+	return strings.ToLower(host)
+}
+
+// NewResolver returns a Resolver, loading settings and policy from the magic config
+// directory, and any nested invocations of magic from the environment (see RecursionEnv).
+// Mappings files are loaded on first use.
+func NewResolver(options ...ResolverOption) (*Resolver, error) {
+	resolver := &Resolver{
+		writer: ioutil.Discard,
+	}
+	for _, option := range options {
+		option(resolver)
+	}
+	if resolver.configDir == "" {
+		resolver.configDir = DefaultConfigDir()
+	}
+	if resolver.mappingsDir == "" && resolver.mappingsFS == nil {
+		resolver.mappingsDir = filepath.Join(resolver.configDir, constants.MappingsSubdir)
+	}
+
+	var err error
+	if resolver.settings, err = LoadSettings(resolver.configDir); err != nil {
+		return nil, err
+	}
+	if resolver.policy, err = LoadPolicy(resolver.configDir); err != nil {
+		return nil, err
+	}
+	if resolver.recursion, err = loadRecursionState(); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// Settings returns the settings loaded from the magic config directory.
+func (resolver *Resolver) Settings() *Settings {
+	return resolver.settings
+}
+
+// Get resolves the source for a server URL, then gets credentials from it.
+func (resolver *Resolver) Get(serverURL string) (*Credentials, error) {
+	source, err := resolver.Resolve(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return resolver.GetFromSource(source)
+}
+
+// Resolve determines the source of credentials for a server URL, in order:
+// the policy file, mappings files, the encrypted store, then the fallback Docker config.
+func (resolver *Resolver) Resolve(serverURL string) (*Source, error) {
+	if reason := resolver.refusalReason(serverURL); reason != "" {
+		fmt.Fprintf(resolver.writer, "[magic] policy: refusing credentials for \"%s\" (%s)\n",
+			serverURL, reason)
+		return &Source{ServerURL: serverURL, Kind: SourceKindRefused, Reason: reason}, nil
+	}
+
+	// TODO: invalid domain includes "localhost:5000" etc.
+	// not supported for now
+	if domain, err := parseDomain(serverURL); err == nil {
+		m, filename, err := resolver.getHelperMapping(domain)
+		if err == nil {
+			return &Source{ServerURL: serverURL, Kind: SourceKindMapping, Mapping: m, Filename: filename}, nil
+		}
+		if err != errorHelperNotFound {
+			return nil, fmt.Errorf("getting helper executable for domain: %v", err)
+		}
+	}
+
+	// If credentials were saved via "store", prefer those
+	if key, err := store.KeyFromEnv(); err == nil {
+		s := store.New(store.DefaultFilename(resolver.configDir), key)
+		if s.Exists() {
+			creds, err := s.Get(serverURL)
+			if err == nil {
+				return &Source{
+					ServerURL:   serverURL,
+					Kind:        SourceKindStore,
+					Filename:    store.DefaultFilename(resolver.configDir),
+					storedCreds: fromStoredCreds(creds),
+				}, nil
+			} else if err != store.ErrNotFound {
+				return nil, fmt.Errorf("loading stored credentials: %v", err)
+			}
+		}
+	} else if err != store.ErrNoKey {
+		return nil, fmt.Errorf("loading store key: %v", err)
+	}
+
+	fallback := resolver.getFallbackDir()
+	if fallback == "" {
+		// If no match and no fallback, use the anonymous token response
+		return &Source{ServerURL: serverURL, Kind: SourceKindAnonymous}, nil
+	}
+
+	cf, err := config.Load(fallback)
+	if err != nil {
+		return nil, fmt.Errorf("loading fallback config \"%s\": %v", fallback, err)
+	}
+
+	// In the following 2 scenarios we could end up with an endless loop, so short circuit
+	// (credHelpers keys are compared ignoring scheme, path and default ports)
+	anonymous := &Source{ServerURL: serverURL, Kind: SourceKindAnonymous, Filename: fallback}
+	if cf.CredentialsStore == constants.MagicCredentialSuffix {
+		return anonymous, nil
+	}
+	for k, v := range cf.CredentialHelpers {
+		if v == constants.MagicCredentialSuffix && RegistryHost(k) == RegistryHost(serverURL) {
+			return anonymous, nil
+		}
+	}
+
+	return &Source{ServerURL: serverURL, Kind: SourceKindFallback, Filename: fallback, fallbackConfig: cf}, nil
+}
+
+// GetFromSource gets credentials from a source previously returned by Resolve.
+// Refused and anonymous sources return empty credentials. Sources which execute
+// a helper fail if this would recurse (see RecursionEnv).
+func (resolver *Resolver) GetFromSource(source *Source) (*Credentials, error) {
+	switch source.Kind {
+	case SourceKindRefused, SourceKindAnonymous:
+		return &Credentials{}, nil
+	case SourceKindStore:
+		return source.storedCreds, nil
+	case SourceKindFallback:
+		// Fallback helpers are executed by the Docker config, with the environment of this process
+		if _, err := resolver.RecursionEnv(source.ServerURL); err != nil {
+			return nil, err
+		}
+		return resolver.getFromFallback(source)
+	case SourceKindMapping:
+		if source.Mapping.Helper == constants.StoreHelper {
+			return resolver.getFromStore(source.ServerURL)
+		}
+		return resolver.getFromHelper(source)
+	}
+	return nil, fmt.Errorf("unknown source kind '%s'", source.Kind)
+}
+
+// Returns why the policy refuses this server URL, or "" if allowed
+func (resolver *Resolver) refusalReason(serverURL string) string {
+	host := RegistryHost(serverURL)
+	for _, pattern := range resolver.policy.Deny {
+		if matchRegistry(pattern, host) {
+			return fmt.Sprintf("denied by \"%s\"", pattern)
+		}
+	}
+	if len(resolver.policy.Allow) == 0 {
+		return ""
+	}
+	for _, pattern := range resolver.policy.Allow {
+		if matchRegistry(pattern, host) {
+			return ""
+		}
+	}
+	return "not in allow list"
+}
+
+func (resolver *Resolver) getHelperMapping(domain string) (*HelperMapping, string, error) {
+	resolver.mappingsOnce.Do(func() {
+		resolver.mappings, resolver.mappingsErr = resolver.loadMappings()
+	})
+	if resolver.mappingsErr != nil {
+		return nil, "", resolver.mappingsErr
+	}
+	for _, lm := range resolver.mappings {
+		for _, d := range lm.mapping.Domains {
+			if d == domain {
+				return lm.mapping, lm.filename, nil
+			}
+		}
+	}
+	return nil, "", errorHelperNotFound
+}
+
+func (resolver *Resolver) loadMappings() ([]*loadedMapping, error) {
+	fsys := resolver.mappingsFS
+	parentDirAbs := ""
+	if fsys == nil {
+		var err error
+		parentDirAbs, err = filepath.Abs(resolver.mappingsDir)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid directory", resolver.mappingsDir)
+		}
+		notExistsErr := fmt.Errorf(
+			"Directory '%s' does not exist.\nHint: Try running \"docker-credential-magic init\"",
+			parentDirAbs)
+		if info, err := os.Stat(parentDirAbs); err != nil || !info.IsDir() {
+			return nil, notExistsErr
+		}
+		fsys = os.DirFS(parentDirAbs)
+	}
+	items, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("reading mappings: %v", err)
+	}
+	var loaded []*loadedMapping
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		filename := item.Name()
+		if parentDirAbs != "" {
+			filename = filepath.Join(parentDirAbs, item.Name())
+		}
+		b, err := fs.ReadFile(fsys, item.Name())
+		if err != nil {
+			return nil, fmt.Errorf("unable to open '%s': %v", filename, err)
+		}
+		var m HelperMapping
+		err = yaml.Unmarshal(b, &m)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mappings for '%s': %v", filename, err)
+		}
+		if !validHelper.MatchString(m.Helper) {
+			return nil, fmt.Errorf("helper '%s' is invalid", m.Helper)
+		}
+		loaded = append(loaded, &loadedMapping{mapping: &m, filename: filename})
+	}
+	return loaded, nil
+}
+
+// Serve credentials from the encrypted store for a domain mapped to it
+func (resolver *Resolver) getFromStore(serverURL string) (*Credentials, error) {
+	key, err := store.KeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("loading store key: %v", err)
+	}
+	creds, err := store.New(store.DefaultFilename(resolver.configDir), key).Get(serverURL)
+	if err == store.ErrNotFound {
+		return nil, ErrCredentialsNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return fromStoredCreds(creds), nil
+}
+
+func (resolver *Resolver) getFromHelper(source *Source) (*Credentials, error) {
+	env, err := resolver.RecursionEnv(source.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	helperExe, err := resolver.getHelperExecutable(source.Mapping)
+	if err != nil {
+		return nil, fmt.Errorf("resolving helper executable: %v", err)
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command(helperExe, constants.HelperSubcommandGet)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(source.ServerURL)
+	cmd.Stderr = resolver.writer
+	cmd.Stdout = &stdout
+	err = cmd.Run()
+	if err != nil {
+		if isCredentialsNotFound(stdout.Bytes()) {
+			return nil, ErrCredentialsNotFound
+		}
+		return nil, fmt.Errorf("exec \"%s\": %v", helperExe, err)
+	}
+	creds, err := resolver.parseHelperResponse(source.ServerURL, stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from \"%s\": %v", helperExe, err)
+	}
+	return creds, nil
+}
+
+func (resolver *Resolver) getFromFallback(source *Source) (*Credentials, error) {
+	cfg, err := source.fallbackConfig.GetAuthConfig(source.ServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("get auth config for domain: %v", err)
+	}
+	creds := toCreds(&authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	})
+	creds.ServerURL = source.ServerURL
+	return creds, nil
+}
+
+func (resolver *Resolver) getFallbackDir() string {
+	if resolver.fallbackDir != "" {
+		return resolver.fallbackDir
+	}
+
+	// If DOCKER_ORIG_CONFIG set, fallback to that
+	if orig := os.Getenv(constants.EnvVarDockerOrigConfig); orig != "" {
+		return orig
+	}
+
+	// If ~/.docker/config.json exists, fallback to that
+	dockerHomeDir := filepath.Join(homedir.Get(), constants.DockerHomeDir)
+	dockerConfigFile := filepath.Join(dockerHomeDir, constants.DockerConfigFileBasename)
+	if _, err := os.Stat(dockerConfigFile); err == nil {
+		return dockerHomeDir
+	}
+	return ""
+}
+
+// Resolve the helper binary for a mapping, verifying its checksum if pinned
+func (resolver *Resolver) getHelperExecutable(m *HelperMapping) (string, error) {
+	helperExe := m.Path
+	if helperExe == "" {
+		var err error
+		helperExe, err = resolver.lookupHelperExecutable(m.Helper)
+		if err != nil {
+			return "", err
+		}
+	} else if !filepath.IsAbs(helperExe) {
+		return "", fmt.Errorf("path '%s' for helper '%s' must be absolute", helperExe, m.Helper)
+	}
+	if m.Sha256 != "" {
+		if err := verifyHelperChecksum(helperExe, m.Sha256); err != nil {
+			return "", err
+		}
+	}
+	return helperExe, nil
+}
+
+// Search the configured helpers dirs, then $PATH (unless disabled)
+func (resolver *Resolver) lookupHelperExecutable(helper string) (string, error) {
+	name := fmt.Sprintf("%s-%s", constants.DockerCredentialPrefix, helper)
+	for _, dir := range resolver.settings.HelpersDirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(resolver.configDir, dir)
+		}
+		filename, err := filepath.Abs(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(filename); err == nil && info.Mode().IsRegular() {
+			return filename, nil
+		}
+	}
+	if resolver.settings.DisablePathLookup {
+		return "", fmt.Errorf("'%s' not found in helpers dirs %v (PATH lookup is disabled)",
+			name, resolver.settings.HelpersDirs)
+	}
+	return exec.LookPath(name)
+}
+
+// Parse and normalize the output of a helper's "get" subcommand. Log lines
+// around the response are tolerated (and ignored), as long as exactly one
+// line is a JSON object.
+func (resolver *Resolver) parseHelperResponse(serverURL string, output []byte) (*Credentials, error) {
+	var resp helperResponse
+	trimmed := bytes.TrimSpace(output)
+	if err := json.Unmarshal(trimmed, &resp); err != nil {
+		resp = helperResponse{}
+		var found int
+		for _, line := range bytes.Split(trimmed, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if !bytes.HasPrefix(line, []byte("{")) {
+				continue
+			}
+			if err := json.Unmarshal(line, &resp); err != nil {
+				return nil, fmt.Errorf("malformed json: %v", err)
+			}
+			found++
+		}
+		if found != 1 {
+			return nil, fmt.Errorf("expected a single json object, found %d", found)
+		}
+		fmt.Fprintf(resolver.writer, "[magic] ignoring extra output from helper\n")
+	}
+
+	creds := &Credentials{
+		ServerURL: resp.ServerURL,
+	}
+	if resp.IdentityToken != "" {
+		creds.Username = constants.IdentityTokenUsername
+		creds.Secret = resp.IdentityToken
+	} else {
+		if resp.Username == nil && resp.Secret == nil {
+			return nil, errors.New("missing Username and Secret")
+		}
+		if resp.Username != nil {
+			creds.Username = *resp.Username
+		}
+		if resp.Secret != nil {
+			creds.Secret = *resp.Secret
+		}
+	}
+	if creds.ServerURL == "" {
+		creds.ServerURL = serverURL
+	}
+	return creds, nil
+}
+
+func verifyHelperChecksum(filename string, expected string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("opening '%s': %v", filename, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hashing '%s': %v", filename, err)
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	expected = strings.ToLower(strings.TrimPrefix(expected, "sha256:"))
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch for '%s': expected sha256 %s, got %s",
+			filename, expected, actual)
+	}
+	return nil
+}
+
+// Detect the various ways helpers report that there are no credentials
+func isCredentialsNotFound(output []byte) bool {
+	return bytes.Contains(bytes.ToLower(output), []byte("credentials not found"))
+}
+
+// Patterns are matched against the registry host (including port, if any),
+// and may contain wildcards, e.g. "*.gcr.io"
+func matchRegistry(pattern string, host string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), host)
+	return err == nil && matched
+}
+
+func parseDomain(s string) (string, error) {
+	parts := strings.Split(s, ".")
+	numParts := len(parts)
+	if numParts < 2 {
+		return "", errorInvalidDomain
+	}
+	root := parts[numParts-2]
+	ext := parts[numParts-1]
+	if root == "" || ext == "" {
+		return "", errorInvalidDomain
+	}
+	domain := strings.Join([]string{root, ext}, ".")
+	return domain, nil
+}
+
+func fromStoredCreds(creds *store.Credentials) *Credentials {
+	return &Credentials{
+		ServerURL: creds.ServerURL,
+		Username:  creds.Username,
+		Secret:    creds.Secret,
+	}
+}
+
+// Borrowed from:
+// https://github.com/google/go-containerregistry/blob/a0b9468898deb31e3eb35f97fa4f0d568e769296/cmd/crane/cmd/auth.go#L53
+func toCreds(config *authn.AuthConfig) *Credentials {
+	creds := &Credentials{
+		Username: config.Username,
+		Secret:   config.Password,
+	}
+
+	if config.IdentityToken != "" {
+		creds.Username = constants.IdentityTokenUsername
+		creds.Secret = config.IdentityToken
+	}
+	return creds
+}
@@ -0,0 +1,469 @@
+package magic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+var (
+	testResolverRootDir = "docker-credential-magic-test"
+	testHelperFilename  = "../../testdata/helpers/docker-credential-example"
+)
+
+type ResolverTestSuite struct {
+	suite.Suite
+	RootDir        string
+	HelperPath     string
+	HelperChecksum string
+}
+
+func (suite *ResolverTestSuite) SetupSuite() {
+	rootDir, err := filepath.Abs(testResolverRootDir)
+	suite.Nil(err, "no error getting root dir absolute path")
+	suite.RootDir = rootDir
+	os.RemoveAll(suite.RootDir)
+	os.Mkdir(suite.RootDir, 0700)
+
+	helperPath, err := filepath.Abs(testHelperFilename)
+	suite.Nil(err, "no error getting helper absolute path")
+	suite.HelperPath = helperPath
+	b, err := ioutil.ReadFile(helperPath)
+	suite.Nil(err, "no error reading example helper")
+	sum := sha256.Sum256(b)
+	suite.HelperChecksum = hex.EncodeToString(sum[:])
+
+	// Make sure the environment does not leak into tests
+	os.Unsetenv(constants.EnvVarDockerCredentialMagicStoreKey)
+	os.Unsetenv(constants.EnvVarDockerCredentialMagicStoreKeyFile)
+	os.Unsetenv(constants.EnvVarDockerCredentialMagicStorePassphrase)
+	os.Unsetenv(constants.EnvVarDockerCredentialMagicDepth)
+	os.Unsetenv(constants.EnvVarDockerCredentialMagicChain)
+}
+
+func (suite *ResolverTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.RootDir)
+}
+
+// Create an empty magic config dir (and empty fallback dir) for a test
+func (suite *ResolverTestSuite) newConfigDir(name string) (string, string) {
+	configDir := filepath.Join(suite.RootDir, name)
+	err := os.MkdirAll(filepath.Join(configDir, constants.MappingsSubdir), 0755)
+	suite.Nil(err, fmt.Sprintf("%s creating config dir", name))
+	fallbackDir := filepath.Join(suite.RootDir, name+"-fallback")
+	err = os.MkdirAll(fallbackDir, 0755)
+	suite.Nil(err, fmt.Sprintf("%s creating fallback dir", name))
+	return configDir, fallbackDir
+}
+
+func (suite *ResolverTestSuite) Test_0_MappingsFS() {
+	configDir, fallbackDir := suite.newConfigDir("test0")
+	mappingsFS := fstest.MapFS{
+		"example.yml": &fstest.MapFile{Data: []byte(fmt.Sprintf(
+			"helper: example\ndomains:\n  - example.com\npath: %s\nsha256: %s\n",
+			suite.HelperPath, suite.HelperChecksum))},
+	}
+	resolver, err := NewResolver(
+		ResolverOptWithConfigDir(configDir),
+		ResolverOptWithMappingsFS(mappingsFS),
+		ResolverOptWithFallbackConfigDir(fallbackDir))
+	suite.Nil(err, "test0 creating resolver")
+
+	source, err := resolver.Resolve("registry.example.com")
+	suite.Nil(err, "test0 resolving mapped domain")
+	suite.Equal(SourceKindMapping, source.Kind)
+	suite.Equal("example", source.Mapping.Helper)
+	suite.Equal("example.yml", source.Filename)
+
+	creds, err := resolver.GetFromSource(source)
+	suite.Nil(err, "test0 getting creds from example helper")
+	suite.Equal("registry.example.com", creds.ServerURL)
+	suite.True(creds.IsAnonymous())
+
+	// Unmapped domain, and fallback dir has no config.json
+	source, err = resolver.Resolve("registry.example.org")
+	suite.Nil(err, "test0 resolving unmapped domain")
+	suite.Equal(SourceKindFallback, source.Kind)
+	suite.Equal(fallbackDir, source.Filename)
+}
+
+func (suite *ResolverTestSuite) Test_1_MappingsDir() {
+	configDir, fallbackDir := suite.newConfigDir("test1")
+	mappingsFilename := filepath.Join(configDir, constants.MappingsSubdir, "example.yml")
+	err := ioutil.WriteFile(mappingsFilename, []byte(fmt.Sprintf(
+		"helper: example\ndomains:\n  - example.com\npath: %s\nsha256: deadbeef\n",
+		suite.HelperPath)), 0644)
+	suite.Nil(err, "test1 writing mappings file")
+
+	resolver, err := NewResolver(
+		ResolverOptWithConfigDir(configDir),
+		ResolverOptWithFallbackConfigDir(fallbackDir))
+	suite.Nil(err, "test1 creating resolver")
+
+	source, err := resolver.Resolve("registry.example.com")
+	suite.Nil(err, "test1 resolving mapped domain")
+	suite.Equal(SourceKindMapping, source.Kind)
+	suite.Equal(mappingsFilename, source.Filename)
+
+	// Checksum mismatch
+	_, err = resolver.GetFromSource(source)
+	suite.NotNil(err, "test1 no error with checksum mismatch")
+
+	// Missing mappings dir
+	resolver, err = NewResolver(
+		ResolverOptWithConfigDir(configDir),
+		ResolverOptWithMappingsDir(filepath.Join(configDir, "some/nonexistant/path")),
+		ResolverOptWithFallbackConfigDir(fallbackDir))
+	suite.Nil(err, "test1 creating resolver with missing mappings dir")
+	_, err = resolver.Get("registry.example.com")
+	suite.NotNil(err, "test1 no error with missing mappings dir")
+}
+
+func (suite *ResolverTestSuite) Test_2_Policy() {
+	configDir, fallbackDir := suite.newConfigDir("test2")
+	err := ioutil.WriteFile(filepath.Join(configDir, constants.PolicyFileBasename),
+		[]byte("allow:\n  - \"*.example.com\"\ndeny:\n  - evil.example.com\n"), 0644)
+	suite.Nil(err, "test2 writing policy file")
+
+	resolver, err := NewResolver(
+		ResolverOptWithConfigDir(configDir),
+		ResolverOptWithMappingsFS(fstest.MapFS{}),
+		ResolverOptWithFallbackConfigDir(fallbackDir))
+	suite.Nil(err, "test2 creating resolver")
+
+	for serverURL, kind := range map[string]SourceKind{
+		"registry.example.com":             SourceKindFallback,
+		"https://registry.example.com/v1/": SourceKindFallback,
+		"evil.example.com":                 SourceKindRefused,
+		"registry.example.org":             SourceKindRefused,
+	} {
+		source, err := resolver.Resolve(serverURL)
+		suite.Nil(err, fmt.Sprintf("test2 resolving %s", serverURL))
+		suite.Equal(kind, source.Kind, serverURL)
+	}
+
+	// Invalid pattern
+	err = ioutil.WriteFile(filepath.Join(configDir, constants.PolicyFileBasename),
+		[]byte("deny:\n  - \"[x\"\n"), 0644)
+	suite.Nil(err, "test2 writing invalid policy file")
+	_, err = NewResolver(ResolverOptWithConfigDir(configDir))
+	suite.NotNil(err, "test2 no error with invalid policy")
+}
+
+func (suite *ResolverTestSuite) Test_3_Fallback() {
+	configDir, fallbackDir := suite.newConfigDir("test3")
+	err := ioutil.WriteFile(filepath.Join(fallbackDir, constants.DockerConfigFileBasename),
+		[]byte(`{
+	"auths": {"localhost:5000": {"username": "myuser", "password": "mypass"}},
+	"credHelpers": {"https://localhost:443": "magic"}
+}`), 0644)
+	suite.Nil(err, "test3 writing fallback config")
+
+	resolver, err := NewResolver(
+		ResolverOptWithConfigDir(configDir),
+		ResolverOptWithMappingsFS(fstest.MapFS{}),
+		ResolverOptWithFallbackConfigDir(fallbackDir))
+	suite.Nil(err, "test3 creating resolver")
+
+	creds, err := resolver.Get("localhost:5000")
+	suite.Nil(err, "test3 getting creds from fallback")
+	suite.Equal(&Credentials{ServerURL: "localhost:5000", Username: "myuser", Secret: "mypass"}, creds)
+
+	// credHelpers entry pointing back at magic
+	source, err := resolver.Resolve("localhost")
+	suite.Nil(err, "test3 resolving magic credHelpers entry")
+	suite.Equal(SourceKindAnonymous, source.Kind)
+}
+
+func (suite *ResolverTestSuite) Test_4_HelperResponses() {
+	resolver, err := NewResolver(ResolverOptWithConfigDir(suite.RootDir))
+	suite.Nil(err, "test4 creating resolver")
+
+	creds, err := resolver.parseHelperResponse("example.com",
+		[]byte("some log line\n{\"Username\":\"u\",\"Secret\":\"s\"}\n"))
+	suite.Nil(err, "test4 parsing response with extra output")
+	suite.Equal(&Credentials{ServerURL: "example.com", Username: "u", Secret: "s"}, creds)
+
+	creds, err = resolver.parseHelperResponse("example.com",
+		[]byte("{\"ServerURL\":\"https://example.com\",\"IdentityToken\":\"t\"}"))
+	suite.Nil(err, "test4 parsing response with identity token")
+	suite.Equal(&Credentials{ServerURL: "https://example.com", Username: "<token>", Secret: "t"}, creds)
+
+	for _, output := range []string{"", "garbage", "{}", "{\"Username\": 5}", "{\"Secret\":\"a\"}\n{\"Secret\":\"b\"}"} {
+		_, err = resolver.parseHelperResponse("example.com", []byte(output))
+		suite.NotNil(err, fmt.Sprintf("test4 no error parsing %q", output))
+	}
+}
+
+func (suite *ResolverTestSuite) Test_5_Keychain() {
+	configDir, fallbackDir := suite.newConfigDir("test5")
+	err := ioutil.WriteFile(filepath.Join(fallbackDir, constants.DockerConfigFileBasename),
+		[]byte(`{
+	"auths": {
+		"localhost:5000": {"username": "myuser", "password": "mypass"},
+		"https://index.docker.io/v1/": {"username": "hubuser", "password": "hubpass"}
+	}
+}`), 0644)
+	suite.Nil(err, "test5 writing fallback config")
+	err = ioutil.WriteFile(filepath.Join(configDir, constants.PolicyFileBasename),
+		[]byte("deny:\n  - evil.example.com\n"), 0644)
+	suite.Nil(err, "test5 writing policy file")
+	mappingsFS := fstest.MapFS{
+		"example.yml": &fstest.MapFile{Data: []byte(fmt.Sprintf(
+			"helper: example\ndomains:\n  - example.com\npath: %s\n", suite.HelperPath))},
+		"missing.yml": &fstest.MapFile{Data: []byte(
+			"helper: missing\ndomains:\n  - missing.io\npath: /nonexistent/docker-credential-missing\n")},
+		"mismatch.yml": &fstest.MapFile{Data: []byte(fmt.Sprintf(
+			"helper: mismatch\ndomains:\n  - mismatch.io\npath: %s\nsha256: deadbeef\n", suite.HelperPath))},
+	}
+
+	var out bytes.Buffer
+	keychain, err := NewKeychain(
+		ResolverOptWithConfigDir(configDir),
+		ResolverOptWithMappingsFS(mappingsFS),
+		ResolverOptWithFallbackConfigDir(fallbackDir),
+		ResolverOptWithWriter(&out))
+	suite.Nil(err, "test5 creating keychain")
+
+	for ref, expected := range map[string]*authn.AuthConfig{
+		"localhost:5000/myimage":            {Username: "myuser", Password: "mypass"},
+		"library/alpine":                    {Username: "hubuser", Password: "hubpass"},
+		"registry.example.com/myimage":      nil,
+		"evil.example.com/myimage":          nil,
+		"registry.example.org:5000/myimage": nil,
+	} {
+		repo, err := name.NewRepository(ref)
+		suite.Nil(err, fmt.Sprintf("test5 parsing %s", ref))
+		auth, err := keychain.Resolve(repo)
+		suite.Nil(err, fmt.Sprintf("test5 resolving %s", ref))
+		if expected == nil {
+			suite.Equal(authn.Anonymous, auth, ref)
+			continue
+		}
+		config, err := auth.Authorization()
+		suite.Nil(err, fmt.Sprintf("test5 getting authorization for %s", ref))
+		suite.Equal(expected, config, ref)
+	}
+
+	// Anonymous results fall through to the next keychain
+	other := authn.NewKeychainFromHelper(staticHelper{"otheruser", "otherpass"})
+	for _, ref := range []string{"registry.example.com/myimage", "evil.example.com/myimage"} {
+		repo, err := name.NewRepository(ref)
+		suite.Nil(err, fmt.Sprintf("test5 parsing %s", ref))
+		auth, err := authn.NewMultiKeychain(keychain, other).Resolve(repo)
+		suite.Nil(err, fmt.Sprintf("test5 resolving %s with multi keychain", ref))
+		config, err := auth.Authorization()
+		suite.Nil(err, fmt.Sprintf("test5 getting authorization for %s from multi keychain", ref))
+		suite.Equal(&authn.AuthConfig{Username: "otheruser", Password: "otherpass"}, config, ref)
+	}
+
+	// Other errors (e.g. a missing helper or a checksum mismatch) are returned, also
+	// from a multi keychain, rather than falling back to anonymous
+	for ref, expected := range map[string]string{
+		"registry.missing.io/myimage":  "registry.missing.io",
+		"registry.mismatch.io/myimage": "checksum mismatch",
+	} {
+		repo, err := name.NewRepository(ref)
+		suite.Nil(err, fmt.Sprintf("test5 parsing %s", ref))
+		_, err = keychain.Resolve(repo)
+		suite.NotNil(err, fmt.Sprintf("test5 no error resolving %s", ref))
+		suite.Contains(err.Error(), expected, ref)
+		_, err = authn.NewMultiKeychain(keychain, other).Resolve(repo)
+		suite.NotNil(err, fmt.Sprintf("test5 no error resolving %s with multi keychain", ref))
+	}
+}
+
+func (suite *ResolverTestSuite) Test_6_RefusalReason() {
+	for _, tc := range []struct {
+		policy    Policy
+		serverURL string
+		reason    string
+	}{
+		// Empty policy allows everything
+		{Policy{}, "registry.example.com", ""},
+		{Policy{}, "localhost:5000", ""},
+
+		// Deny only
+		{Policy{Deny: []string{"evil.example.com"}}, "evil.example.com", "denied by \"evil.example.com\""},
+		{Policy{Deny: []string{"evil.example.com"}}, "https://EVIL.example.com:443/v2/", "denied by \"evil.example.com\""},
+		{Policy{Deny: []string{"evil.example.com"}}, "good.example.com", ""},
+		{Policy{Deny: []string{"*.example.com"}}, "example.com", ""},
+
+		// Allow only
+		{Policy{Allow: []string{"*.example.com"}}, "registry.example.com", ""},
+		{Policy{Allow: []string{"*.example.com"}}, "registry.example.org", "not in allow list"},
+		{Policy{Allow: []string{"*.example.com"}}, "registry.example.com:5000", "not in allow list"},
+		{Policy{Allow: []string{"localhost:*"}}, "localhost:5000", ""},
+		{Policy{Allow: []string{"*.EXAMPLE.com"}}, "registry.example.com", ""},
+
+		// Deny takes precedence over allow
+		{Policy{Allow: []string{"*.example.com"}, Deny: []string{"evil.example.com"}}, "evil.example.com", "denied by \"evil.example.com\""},
+		{Policy{Allow: []string{"evil.example.com"}, Deny: []string{"*"}}, "evil.example.com", "denied by \"*\""},
+	} {
+		policy := tc.policy
+		resolver := &Resolver{policy: &policy}
+		suite.Equal(tc.reason, resolver.refusalReason(tc.serverURL),
+			fmt.Sprintf("test6 refusal reason for %s with %+v", tc.serverURL, tc.policy))
+	}
+}
+
+func (suite *ResolverTestSuite) Test_7_ParseHelperResponse() {
+	for _, tc := range []struct {
+		output   string
+		expected *Credentials
+		extra    bool
+	}{
+		// Plain responses, with ServerURL defaulting to the one requested
+		{"{\"Username\":\"u\",\"Secret\":\"s\"}",
+			&Credentials{ServerURL: "example.com", Username: "u", Secret: "s"}, false},
+		{"\n  {\"ServerURL\":\"https://example.com\",\"Username\":\"u\",\"Secret\":\"s\"}  \n",
+			&Credentials{ServerURL: "https://example.com", Username: "u", Secret: "s"}, false},
+		{"{\"Username\":\"u\"}",
+			&Credentials{ServerURL: "example.com", Username: "u"}, false},
+		{"{\"Secret\":\"s\"}",
+			&Credentials{ServerURL: "example.com", Secret: "s"}, false},
+		{"{\"Username\":\"\",\"Secret\":\"\"}",
+			&Credentials{ServerURL: "example.com"}, false},
+
+		// IdentityToken takes precedence over Username and Secret
+		{"{\"Username\":\"u\",\"Secret\":\"s\",\"IdentityToken\":\"t\"}",
+			&Credentials{ServerURL: "example.com", Username: constants.IdentityTokenUsername, Secret: "t"}, false},
+
+		// Log lines around the response
+		{"starting\n{\"Username\":\"u\",\"Secret\":\"s\"}\ndone\n",
+			&Credentials{ServerURL: "example.com", Username: "u", Secret: "s"}, true},
+	} {
+		var out bytes.Buffer
+		resolver := &Resolver{writer: &out}
+		creds, err := resolver.parseHelperResponse("example.com", []byte(tc.output))
+		suite.Nil(err, fmt.Sprintf("test7 parsing %q", tc.output))
+		suite.Equal(tc.expected, creds, tc.output)
+		suite.Equal(tc.extra, strings.Contains(out.String(), "ignoring extra output"),
+			fmt.Sprintf("test7 logging extra output for %q", tc.output))
+	}
+
+	for _, output := range []string{
+		"",
+		"credentials not found in native keychain",
+		"{}",
+		"{\"IdentityToken\":\"\"}",
+		"{\"Username\":[]}",
+		"{\"Username\":\"u\",",
+		"log\n{\"Username\":\"u\",\n",
+		"{\"Username\":\"a\"}\n{\"Username\":\"b\"}",
+	} {
+		resolver := &Resolver{writer: ioutil.Discard}
+		_, err := resolver.parseHelperResponse("example.com", []byte(output))
+		suite.NotNil(err, fmt.Sprintf("test7 no error parsing %q", output))
+	}
+}
+
+func (suite *ResolverTestSuite) Test_8_Recursion() {
+	configDir, fallbackDir := suite.newConfigDir("test8")
+	defer os.Unsetenv(constants.EnvVarDockerCredentialMagicDepth)
+	defer os.Unsetenv(constants.EnvVarDockerCredentialMagicChain)
+
+	// A helper which reports the recursion state it was run with
+	helperPath := filepath.Join(configDir, "docker-credential-env")
+	err := ioutil.WriteFile(helperPath, []byte(fmt.Sprintf(
+		"#!/bin/sh\necho \"{\\\"Username\\\":\\\"$%s\\\",\\\"Secret\\\":\\\"$%s\\\"}\"\n",
+		constants.EnvVarDockerCredentialMagicDepth, constants.EnvVarDockerCredentialMagicChain)), 0755)
+	suite.Nil(err, "test8 writing env helper")
+	newResolver := func(depth string, chain string) (*Resolver, error) {
+		os.Setenv(constants.EnvVarDockerCredentialMagicDepth, depth)
+		os.Setenv(constants.EnvVarDockerCredentialMagicChain, chain)
+		return NewResolver(
+			ResolverOptWithConfigDir(configDir),
+			ResolverOptWithMappingsFS(fstest.MapFS{
+				"env.yml": &fstest.MapFile{Data: []byte(fmt.Sprintf(
+					"helper: env\ndomains:\n  - example.com\npath: %s\n", helperPath))},
+			}),
+			ResolverOptWithFallbackConfigDir(fallbackDir))
+	}
+
+	// Not nested
+	resolver, err := newResolver("", "")
+	suite.Nil(err, "test8 creating resolver")
+	creds, err := resolver.Get("registry.example.com")
+	suite.Nil(err, "test8 getting creds")
+	suite.Equal(&Credentials{ServerURL: "registry.example.com", Username: "1", Secret: "registry.example.com"}, creds)
+
+	// Nested, for another registry
+	resolver, err = newResolver("1", "other.example.org")
+	suite.Nil(err, "test8 creating nested resolver")
+	env, err := resolver.RecursionEnv("https://registry.example.com/v2/")
+	suite.Nil(err, "test8 getting nested env")
+	suite.Equal([]string{
+		constants.EnvVarDockerCredentialMagicDepth + "=2",
+		constants.EnvVarDockerCredentialMagicChain + "=other.example.org,registry.example.com",
+	}, env)
+	creds, err = resolver.Get("registry.example.com")
+	suite.Nil(err, "test8 getting nested creds")
+	suite.Equal(&Credentials{ServerURL: "registry.example.com", Username: "2",
+		Secret: "other.example.org,registry.example.com"}, creds)
+
+	// The environment is only read when the resolver is created
+	os.Setenv(constants.EnvVarDockerCredentialMagicChain, "registry.example.com")
+	_, err = resolver.RecursionEnv("registry.example.com")
+	suite.Nil(err, "test8 environment changed after creating resolver")
+
+	// Chain cycle, for both helpers and fallbacks
+	resolver, err = newResolver("2", "registry.example.com,other.example.org")
+	suite.Nil(err, "test8 creating resolver with cycle")
+	_, err = resolver.RecursionEnv("REGISTRY.example.com:443")
+	suite.NotNil(err, "test8 no error with cycle")
+	suite.Contains(err.Error(), "registry.example.com -> other.example.org -> registry.example.com")
+	_, err = resolver.Get("registry.example.com")
+	suite.NotNil(err, "test8 no error getting creds with cycle")
+	_, err = resolver.Get("localhost:5000")
+	suite.Nil(err, "test8 getting creds for another registry from fallback")
+	_, err = resolver.Get("other.example.org")
+	suite.NotNil(err, "test8 no error getting creds from fallback with cycle")
+
+	// Depth limit
+	chain := []string{}
+	for i := 0; i < constants.MaxInvocationDepth; i++ {
+		chain = append(chain, fmt.Sprintf("registry%d.example.org", i))
+	}
+	resolver, err = newResolver(fmt.Sprint(constants.MaxInvocationDepth-1), strings.Join(chain[1:], ","))
+	suite.Nil(err, "test8 creating resolver below depth limit")
+	_, err = resolver.RecursionEnv("registry.example.com")
+	suite.Nil(err, "test8 below depth limit")
+	resolver, err = newResolver(fmt.Sprint(constants.MaxInvocationDepth), strings.Join(chain, ","))
+	suite.Nil(err, "test8 creating resolver at depth limit")
+	_, err = resolver.RecursionEnv("registry.example.com")
+	suite.NotNil(err, "test8 no error at depth limit")
+	suite.Contains(err.Error(), "maximum depth")
+	_, err = resolver.Get("registry.example.com")
+	suite.NotNil(err, "test8 no error getting creds at depth limit")
+
+	// Invalid depth
+	_, err = newResolver("many", "")
+	suite.NotNil(err, "test8 no error with invalid depth")
+}
+
+type staticHelper struct {
+	username string
+	password string
+}
+
+func (h staticHelper) Get(string) (string, string, error) {
+	return h.username, h.password, nil
+}
+
+func TestResolverTestSuite(t *testing.T) {
+	suite.Run(t, new(ResolverTestSuite))
+}
@@ -0,0 +1,56 @@
+package magic
+
+// HelperMapping maps a set of domains to a Docker credential helper.
+type HelperMapping struct {
+	Helper  string
+	Domains []string
+
+	// Optional absolute path to the helper binary, and its expected sha256 digest (hex).
+	// If set, magic refuses to exec a helper binary which does not match.
+	Path   string `yaml:"path,omitempty"`
+	Sha256 string `yaml:"sha256,omitempty"`
+
+	// Optional version, upstream URL and license (SPDX identifier) of the helper binary,
+	// recorded by magician in mutated images and their SBOMs.
+	Version string `yaml:"version,omitempty"`
+	URL     string `yaml:"url,omitempty"`
+	License string `yaml:"license,omitempty"`
+}
+
+// Settings are loaded from the optional magic.yml file in the magic config directory.
+type Settings struct {
+	// Directories searched (in order) for helper binaries. Relative
+	// directories are resolved against the magic config directory.
+	HelpersDirs []string `yaml:"helpers_dirs,omitempty"`
+
+	// If true, never fall back to searching $PATH for helper binaries.
+	DisablePathLookup bool `yaml:"disable_path_lookup,omitempty"`
+
+	// If set, append a JSON line for each "get" request to this file. A relative
+	// path is resolved against the magic config directory.
+	AuditLog           string `yaml:"audit_log,omitempty"`
+	AuditLogMaxSize    int64  `yaml:"audit_log_max_size,omitempty"`
+	AuditLogMaxBackups int    `yaml:"audit_log_max_backups,omitempty"`
+}
+
+// Policy is loaded from the optional policy.yml file in the magic config directory.
+type Policy struct {
+	// Registries allowed to receive credentials. If empty, all registries
+	// not matched by Deny are allowed.
+	Allow []string `yaml:"allow,omitempty"`
+
+	// Registries which always get the anonymous response.
+	Deny []string `yaml:"deny,omitempty"`
+}
+
+// Credentials for a registry, per the Docker credential helper protocol.
+type Credentials struct {
+	ServerURL string `json:",omitempty"`
+	Username  string
+	Secret    string
+}
+
+// IsAnonymous returns whether the credentials are empty.
+func (c *Credentials) IsAnonymous() bool {
+	return c.Username == "" && c.Secret == ""
+}
@@ -0,0 +1,237 @@
+package magician
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// An in-toto statement with a SLSA provenance (v0.2) predicate, see https://slsa.dev/provenance/v0.2
+type (
+	inTotoStatement struct {
+		Type          string              `json:"_type"`
+		PredicateType string              `json:"predicateType"`
+		Subject       []inTotoSubject     `json:"subject"`
+		Predicate     provenancePredicate `json:"predicate"`
+	}
+
+	inTotoSubject struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	}
+
+	provenancePredicate struct {
+		Builder    provenanceBuilder    `json:"builder"`
+		BuildType  string               `json:"buildType"`
+		Invocation provenanceInvocation `json:"invocation"`
+		Metadata   provenanceMetadata   `json:"metadata"`
+		Materials  []provenanceMaterial `json:"materials"`
+	}
+
+	provenanceBuilder struct {
+		ID string `json:"id"`
+	}
+
+	provenanceInvocation struct {
+		Parameters provenanceParameters `json:"parameters"`
+	}
+
+	// The options of the mutate operation
+	provenanceParameters struct {
+		Source            string   `json:"source"`
+		Destination       string   `json:"destination"`
+		Helpers           []string `json:"helpers"`
+		HelpersDir        string   `json:"helpersDir,omitempty"`
+		MappingsDir       string   `json:"mappingsDir,omitempty"`
+		DisablePathLookup bool     `json:"disablePathLookup"`
+		AllowArchMismatch bool     `json:"allowArchMismatch"`
+		SkipUnsupported   bool     `json:"skipUnsupportedPlatforms"`
+		Platform          string   `json:"platform,omitempty"`
+	}
+
+	provenanceMetadata struct {
+		BuildStartedOn  string `json:"buildStartedOn"`
+		BuildFinishedOn string `json:"buildFinishedOn"`
+	}
+
+	provenanceMaterial struct {
+		URI    string            `json:"uri"`
+		Digest map[string]string `json:"digest"`
+	}
+
+	// A DSSE envelope (https://github.com/secure-systems-lab/dsse), as used by "cosign attest"
+	dsseEnvelope struct {
+		PayloadType string          `json:"payloadType"`
+		Payload     string          `json:"payload"`
+		Signatures  []dsseSignature `json:"signatures"`
+	}
+
+	dsseSignature struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	}
+)
+
+func mutateStepWriteProvenance(operation *mutateOperation) error {
+	provenanceFile, provenanceAttach := operation.configurable.provenanceFile, operation.configurable.provenanceAttach
+	if provenanceFile == "" && !provenanceAttach {
+		return nil
+	}
+	statement, err := mutateUtilBuildProvenance(operation)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("encoding provenance: %v", err)
+	}
+	envelope := dsseEnvelope{
+		PayloadType: constants.InTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []dsseSignature{},
+	}
+	if signer := operation.configurable.signer; signer != nil {
+		sig, err := signer.Sign(mutateUtilGetDSSEPreAuthEncoding(constants.InTotoPayloadType, payload))
+		if err != nil {
+			return fmt.Errorf("signing provenance: %v", err)
+		}
+		envelope.Signatures = append(envelope.Signatures, dsseSignature{Sig: base64.StdEncoding.EncodeToString(sig)})
+	}
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("encoding provenance envelope: %v", err)
+	}
+	if provenanceFile != "" {
+		operation.runtime.logger.Printf("Writing provenance to %s ...\n", provenanceFile)
+		if err := ioutil.WriteFile(provenanceFile, append(b, '\n'), 0644); err != nil {
+			return fmt.Errorf("writing provenance: %v", err)
+		}
+	}
+	if provenanceAttach {
+		subject := operation.runtime.destination.ref.Context().Digest(operation.runtime.plan.Digest)
+		operation.runtime.logger.Printf("Attaching provenance attestation to %s ...\n", subject.String())
+		annotations := map[string]string{
+			constants.AnnotationPredicateType: constants.ProvenancePredicateType,
+		}
+		if _, err := mutateUtilPushReferrer(operation, constants.InTotoPayloadType, b,
+			constants.DSSEMediaType, annotations); err != nil {
+			return fmt.Errorf("attach provenance: %v", err)
+		}
+	}
+	return nil
+}
+
+// Build a provenance statement for the new image (or index). Its materials are the
+// source image (and each image of a source index) and every helper binary added.
+func mutateUtilBuildProvenance(operation *mutateOperation) (*inTotoStatement, error) {
+	plan := operation.runtime.plan
+	destination := operation.runtime.destination
+	subjectName := destination.String()
+	if destination.isRegistry() {
+		subjectName = destination.ref.Context().Name()
+	}
+	subject, err := mutateUtilGetDigestSet(plan.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters := provenanceParameters{
+		Source:            plan.Source,
+		Destination:       plan.Destination,
+		Helpers:           operation.runtime.requestedHelpers,
+		DisablePathLookup: operation.configurable.disablePathLookup,
+		AllowArchMismatch: operation.configurable.allowArchMismatch,
+		SkipUnsupported:   operation.configurable.skipUnsupported,
+	}
+	// Only record whether custom dirs were used, not their paths on this machine
+	if operation.configurable.helpersDir != "" {
+		parameters.HelpersDir = provenanceCustomDir
+	}
+	if operation.configurable.mappingsDir != "" {
+		parameters.MappingsDir = provenanceCustomDir
+	}
+	if platform := operation.configurable.platform; platform != nil {
+		parameters.Platform = mutateUtilGetPlatformString(platform)
+	}
+
+	var materials []provenanceMaterial
+	seen := map[string]bool{}
+	addMaterial := func(uri string, digest string) error {
+		if seen[uri+"@"+digest] {
+			return nil
+		}
+		seen[uri+"@"+digest] = true
+		digestSet, err := mutateUtilGetDigestSet(digest)
+		if err != nil {
+			return err
+		}
+		materials = append(materials, provenanceMaterial{URI: uri, Digest: digestSet})
+		return nil
+	}
+	source := operation.runtime.sourceLocation.String()
+	if baseIndex := operation.runtime.baseIndex; baseIndex != nil {
+		digest, err := baseIndex.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("base index digest: %v", err)
+		}
+		if err := addMaterial(source, digest.String()); err != nil {
+			return nil, err
+		}
+	}
+	for _, imagePlan := range plan.Images {
+		if err := addMaterial(source, imagePlan.BaseDigest); err != nil {
+			return nil, err
+		}
+	}
+	for _, imagePlan := range plan.Images {
+		for _, helper := range imagePlan.helpers {
+			uri := fmt.Sprintf("pkg:generic/%s-%s", constants.DockerCredentialPrefix, helper.name)
+			version := helper.version
+			if helper.name == constants.MagicCredentialSuffix {
+				version = mutateUtilGetMagicVersion(operation)
+			}
+			if version != "" {
+				uri = fmt.Sprintf("%s@%s", uri, version)
+			}
+			if err := addMaterial(uri, fmt.Sprintf("sha256:%s", helper.sha256)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &inTotoStatement{
+		Type:          constants.InTotoStatementType,
+		PredicateType: constants.ProvenancePredicateType,
+		Subject:       []inTotoSubject{{Name: subjectName, Digest: subject}},
+		Predicate: provenancePredicate{
+			Builder:    provenanceBuilder{ID: mutateUtilGetBuilder(operation)},
+			BuildType:  constants.MagicMutateBuildType,
+			Invocation: provenanceInvocation{Parameters: parameters},
+			Metadata: provenanceMetadata{
+				BuildStartedOn:  operation.runtime.startTime.UTC().Format(time.RFC3339),
+				BuildFinishedOn: time.Now().UTC().Format(time.RFC3339),
+			},
+			Materials: materials,
+		},
+	}, nil
+}
+
+// Convert a digest (e.g. "sha256:<hex>") to an in-toto digest set
+func mutateUtilGetDigestSet(digest string) (map[string]string, error) {
+	hash, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing digest %q: %v", digest, err)
+	}
+	return map[string]string{hash.Algorithm: hash.Hex}, nil
+}
+
+// The bytes signed for a DSSE envelope ("pre-authentication encoding")
+func mutateUtilGetDSSEPreAuthEncoding(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
@@ -0,0 +1,289 @@
+package magician
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+	"github.com/docker-credential-magic/docker-credential-magic/pkg/magic"
+)
+
+type (
+	// InspectResult describes the magic found in an image (or in each image of an index).
+	InspectResult struct {
+		Source string          `json:"source"`
+		Images []*InspectImage `json:"images"`
+	}
+
+	// InspectImage describes the magic found in a single (platform) image.
+	InspectImage struct {
+		Platform        string           `json:"platform"`
+		Digest          string           `json:"digest"`
+		Magic           bool             `json:"magic"`
+		MagicianVersion string           `json:"magicianVersion,omitempty"`
+		Helpers         []InspectHelper  `json:"helpers"`
+		Mappings        []InspectMapping `json:"mappings"`
+		Env             []InspectEnvVar  `json:"env"`
+	}
+
+	// InspectHelper is a helper binary found in /opt/magic/bin.
+	InspectHelper struct {
+		Name   string `json:"name"`
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		Sha256 string `json:"sha256"`
+	}
+
+	// InspectMapping is a mappings file found in /opt/magic/etc.
+	InspectMapping struct {
+		Slug    string   `json:"slug"`
+		Path    string   `json:"path"`
+		Helper  string   `json:"helper"`
+		Domains []string `json:"domains"`
+		Sha256  string   `json:"sha256,omitempty"`
+	}
+
+	// InspectEnvVar is a magic-related env var set in the image config.
+	InspectEnvVar struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	// A regular file found under /opt/magic
+	inspectFile struct {
+		size   int64
+		sha256 string
+		data   []byte
+	}
+)
+
+// Inspect reports which helpers, mappings and env vars magician added to an image,
+// by reading its layers (so without running a container). Registry-related options
+// (and MutateOptWithPlatform) are used as for Mutate; other options are ignored.
+func Inspect(source string, options ...MutateOption) (*InspectResult, error) {
+	return InspectWithContext(context.Background(), source, options...)
+}
+
+// InspectWithContext is like Inspect, but stops once the provided context is canceled or expires.
+func InspectWithContext(ctx context.Context, source string, options ...MutateOption) (*InspectResult, error) {
+	operation := mutateUtilNewOperation(ctx, source, options...)
+	result := &InspectResult{Source: source}
+	if err := mutateUtilRunSteps(operation, []mutateStep{
+		mutateStepSetLogger,
+		mutateStepSetDestination,
+		mutateStepSetKeychains,
+		mutateStepSetTransports,
+		mutateStepPullBaseImage,
+		func(operation *mutateOperation) error {
+			images, err := inspectUtilInspectImages(operation)
+			result.Images = images
+			return err
+		},
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Inspect the pulled image, or each image of the pulled index (or only the one selected by platform)
+func inspectUtilInspectImages(operation *mutateOperation) ([]*InspectImage, error) {
+	if operation.runtime.baseIndex == nil {
+		platform := operation.configurable.platform
+		if platform == nil {
+			imagePlatform, err := mutateUtilGetImagePlatform(operation.runtime.baseImage)
+			if err != nil {
+				return nil, err
+			}
+			platform = imagePlatform
+		}
+		image, err := inspectUtilInspectImage(operation, operation.runtime.baseImage, platform)
+		if err != nil {
+			return nil, err
+		}
+		return []*InspectImage{image}, nil
+	}
+	if operation.configurable.platform != nil {
+		if err := mutateUtilSelectPlatformImage(operation); err != nil {
+			return nil, err
+		}
+		image, err := inspectUtilInspectImage(operation, operation.runtime.baseImage, operation.runtime.platform)
+		if err != nil {
+			return nil, err
+		}
+		return []*InspectImage{image}, nil
+	}
+	indexManifest, err := operation.runtime.baseIndex.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("loading index manifest: %v", err)
+	}
+	var images []*InspectImage
+	for _, desc := range indexManifest.Manifests {
+		if !desc.MediaType.IsImage() || desc.Platform == nil {
+			continue
+		}
+		if err := operation.runtime.ctx.Err(); err != nil {
+			return nil, fmt.Errorf("inspect stopped: %w", err)
+		}
+		img, err := operation.runtime.baseIndex.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("loading image for platform %s: %v",
+				mutateUtilGetPlatformString(desc.Platform), err)
+		}
+		image, err := inspectUtilInspectImage(operation, img, desc.Platform)
+		if err != nil {
+			return nil, fmt.Errorf("platform %s: %v", mutateUtilGetPlatformString(desc.Platform), err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func inspectUtilInspectImage(operation *mutateOperation, img v1.Image, platform *v1.Platform) (*InspectImage, error) {
+	if platform == nil {
+		platform = &defaultPlatform
+	}
+	operation.runtime.logger.Printf("Inspecting image for platform %s ...\n", mutateUtilGetPlatformString(platform))
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("image digest: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("load image config: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("load image layers: %v", err)
+	}
+	image := &InspectImage{
+		Platform: mutateUtilGetPlatformString(platform),
+		Digest:   digest.String(),
+	}
+
+	// A magic layer added by magician contains everything, so only it needs to be read
+	hasMagicLayer, err := mutateUtilHasMagicLayer(img)
+	if err != nil {
+		return nil, err
+	}
+	if hasMagicLayer {
+		if v, ok := cfg.Config.Labels[constants.LabelVersion]; ok {
+			image.MagicianVersion = v
+		} else if i := mutateUtilGetTopLayerHistoryIndex(cfg, len(layers)); i >= 0 {
+			// Older versions recorded only the version, newer ones the whole command
+			image.MagicianVersion = strings.SplitN(cfg.History[i].CreatedBy, " ", 2)[0]
+		}
+		layers = layers[len(layers)-1:]
+	}
+	files, err := inspectUtilGetMagicFiles(layers)
+	if err != nil {
+		return nil, err
+	}
+	image.Magic = len(files) > 0
+
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	binDir := path.Join(constants.MagicRootDir, constants.BinariesSubdir)
+	mappingsDir := path.Join(constants.MagicRootDir, constants.MappingsSubdir)
+	for _, p := range paths {
+		f := files[p]
+		switch path.Dir(p) {
+		case binDir:
+			image.Helpers = append(image.Helpers, InspectHelper{
+				Name:   strings.TrimPrefix(path.Base(p), fmt.Sprintf("%s-", constants.DockerCredentialPrefix)),
+				Path:   p,
+				Size:   f.size,
+				Sha256: f.sha256,
+			})
+		case mappingsDir:
+			var m magic.HelperMapping
+			if err := yaml.Unmarshal(f.data, &m); err != nil {
+				return nil, fmt.Errorf("parsing mappings file %s: %v", p, err)
+			}
+			image.Mappings = append(image.Mappings, InspectMapping{
+				Slug:    strings.TrimSuffix(path.Base(p), path.Ext(p)),
+				Path:    p,
+				Helper:  m.Helper,
+				Domains: m.Domains,
+				Sha256:  m.Sha256,
+			})
+		}
+	}
+	for _, key := range magicEnvVars {
+		if i, v := mutateUtilGetImageConfigEnvVar(cfg, key); i >= 0 {
+			image.Env = append(image.Env, InspectEnvVar{Name: key, Value: v})
+		}
+	}
+	return image, nil
+}
+
+// Collect the regular files under /opt/magic in the given layers (applied in order,
+// including whiteouts), keyed by absolute path
+func inspectUtilGetMagicFiles(layers []v1.Layer) (map[string]*inspectFile, error) {
+	root := strings.TrimPrefix(constants.MagicRootDir, "/")
+	inRoot := func(p string) bool {
+		return p == root || strings.HasPrefix(p, root+"/")
+	}
+	files := map[string]*inspectFile{}
+	for _, layer := range layers {
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return nil, fmt.Errorf("reading layer: %v", err)
+		}
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rc.Close()
+				return nil, fmt.Errorf("reading layer: %v", err)
+			}
+			p := strings.TrimPrefix(path.Clean(hdr.Name), "/")
+			dir, base := path.Split(p)
+			if strings.HasPrefix(base, ".wh.") {
+				// Whiteouts delete a file (or everything in a directory) from lower layers
+				deleted := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+				if base == ".wh..wh..opq" {
+					deleted = path.Clean(dir)
+				}
+				for f := range files {
+					if f == "/"+deleted || strings.HasPrefix(f, "/"+deleted+"/") {
+						delete(files, f)
+					}
+				}
+				continue
+			}
+			if !inRoot(p) || hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				rc.Close()
+				return nil, fmt.Errorf("reading layer file %s: %v", p, err)
+			}
+			sum := sha256.Sum256(b)
+			f := &inspectFile{size: hdr.Size, sha256: hex.EncodeToString(sum[:])}
+			if path.Ext(p) == fmt.Sprintf(".%s", constants.ExtensionYAML) {
+				f.data = b
+			}
+			files["/"+p] = f
+		}
+		rc.Close()
+	}
+	return files, nil
+}
@@ -0,0 +1,175 @@
+package magician
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// Check whether the top layer of an image is a magic layer added by a previous mutate.
+// Layers are marked with a history comment; images mutated before the marker existed are
+// detected by their env and a top layer containing nothing but files under /opt/magic.
+func mutateUtilHasMagicLayer(img v1.Image) (bool, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return false, fmt.Errorf("load image config: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return false, fmt.Errorf("load image layers: %v", err)
+	}
+	if len(layers) == 0 {
+		return false, nil
+	}
+	if i := mutateUtilGetTopLayerHistoryIndex(cfg, len(layers)); i >= 0 &&
+		cfg.History[i].Comment == constants.MagicLayerComment {
+		return true, nil
+	}
+	if _, v := mutateUtilGetImageConfigEnvVar(cfg, constants.EnvVarDockerCredentialMagicConfig); v != constants.MagicRootDir {
+		return false, nil
+	}
+	rc, err := layers[len(layers)-1].Uncompressed()
+	if err != nil {
+		return false, fmt.Errorf("reading top layer: %v", err)
+	}
+	defer rc.Close()
+	prefix := fmt.Sprintf("%s/", strings.TrimPrefix(constants.MagicRootDir, "/"))
+	tr := tar.NewReader(rc)
+	var numFiles int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading top layer: %v", err)
+		}
+		if !strings.HasPrefix(strings.TrimPrefix(hdr.Name, "./"), prefix) {
+			return false, nil
+		}
+		numFiles++
+	}
+	return numFiles > 0, nil
+}
+
+// Rebuild an image without its top (magic) layer, and without the env vars, labels and
+// annotations added along with it, keeping the rest of the config, media types,
+// annotations and the history of every other layer
+func mutateUtilRemoveMagicLayer(img v1.Image) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("load image config: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("load image manifest: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("load image layers: %v", err)
+	}
+
+	newCfg := cfg.DeepCopy()
+	newCfg.RootFS.DiffIDs = nil
+	newCfg.History = nil
+	mutateUtilRestoreImageConfig(newCfg)
+	base, err := mutate.ConfigFile(empty.Image, newCfg)
+	if err != nil {
+		return nil, fmt.Errorf("mutate config file: %v", err)
+	}
+	base = mutate.MediaType(base, manifest.MediaType)
+	base = mutate.ConfigMediaType(base, manifest.Config.MediaType)
+	if annotations := mutateUtilRemoveProvenanceAnnotations(manifest.Annotations); len(annotations) > 0 {
+		base = mutate.Annotations(base, annotations).(v1.Image)
+	}
+
+	// Pair each remaining layer with its history entry (if history is complete),
+	// keeping history entries of empty layers where they were
+	var adds []mutate.Addendum
+	top := mutateUtilGetTopLayerHistoryIndex(cfg, len(layers))
+	if top >= 0 {
+		var l int
+		for i, h := range cfg.History {
+			if i == top {
+				continue
+			}
+			if h.EmptyLayer {
+				adds = append(adds, mutate.Addendum{History: h})
+				continue
+			}
+			adds = append(adds, mutateUtilGetLayerAddendum(manifest, layers, l, h))
+			l++
+		}
+	} else {
+		for l := 0; l < len(layers)-1; l++ {
+			adds = append(adds, mutateUtilGetLayerAddendum(manifest, layers, l, v1.History{}))
+		}
+	}
+	newImg, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("append layers: %v", err)
+	}
+	return newImg, nil
+}
+
+func mutateUtilGetLayerAddendum(manifest *v1.Manifest, layers []v1.Layer, l int, h v1.History) mutate.Addendum {
+	return mutate.Addendum{
+		Layer:       layers[l],
+		History:     h,
+		URLs:        manifest.Layers[l].URLs,
+		Annotations: manifest.Layers[l].Annotations,
+		MediaType:   manifest.Layers[l].MediaType,
+	}
+}
+
+// Index of the history entry for the top layer, or -1 if history does not cover every layer
+func mutateUtilGetTopLayerHistoryIndex(cfg *v1.ConfigFile, numLayers int) int {
+	top := -1
+	var numNonEmpty int
+	for i, h := range cfg.History {
+		if !h.EmptyLayer {
+			top = i
+			numNonEmpty++
+		}
+	}
+	if numNonEmpty != numLayers {
+		return -1
+	}
+	return top
+}
+
+// Undo the env and label changes made by a previous mutate, so they are not applied twice
+func mutateUtilRestoreImageConfig(cfg *v1.ConfigFile) {
+	cfg.Config.Labels = mutateUtilRemoveProvenanceLabels(cfg.Config.Labels)
+	if _, v := mutateUtilGetImageConfigEnvVar(cfg, constants.EnvVarPath); v != "" {
+		binDir := fmt.Sprintf("%s/%s", constants.MagicRootDir, constants.BinariesSubdir)
+		var dirs []string
+		for _, dir := range strings.Split(v, ":") {
+			if dir != binDir {
+				dirs = append(dirs, dir)
+			}
+		}
+		if len(dirs) > 0 {
+			mutateUtilSetImageConfigEnvVar(cfg, constants.EnvVarPath, strings.Join(dirs, ":"))
+		} else {
+			mutateUtilUnsetImageConfigEnvVar(cfg, constants.EnvVarPath)
+		}
+	}
+	if _, v := mutateUtilGetImageConfigEnvVar(cfg, constants.EnvVarDockerConfig); v == constants.MagicRootDir {
+		_, origDockerConfig := mutateUtilGetImageConfigEnvVar(cfg, constants.EnvVarDockerOrigConfig)
+		if origDockerConfig != "" {
+			mutateUtilSetImageConfigEnvVar(cfg, constants.EnvVarDockerConfig, origDockerConfig)
+		} else {
+			mutateUtilUnsetImageConfigEnvVar(cfg, constants.EnvVarDockerConfig)
+		}
+		mutateUtilUnsetImageConfigEnvVar(cfg, constants.EnvVarDockerOrigConfig)
+	}
+	mutateUtilUnsetImageConfigEnvVar(cfg, constants.EnvVarDockerCredentialMagicConfig)
+}
@@ -0,0 +1,256 @@
+package magician
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	// Prefixes of sources and destinations which are not remote registries
+	locationPrefixOCI          = "oci:"
+	locationPrefixTarball      = "tarball:"
+	locationPrefixDockerDaemon = "docker-daemon:"
+
+	// Annotation used to tag images within an OCI layout
+	locationOCIRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+type (
+	mutateLocationKind int
+
+	// Where an image is pulled from or pushed to
+	mutateLocation struct {
+		kind mutateLocationKind
+		raw  string
+
+		// Set for registry and docker daemon locations, and tarball locations with a tag
+		ref name.Reference
+
+		// Set for OCI layout and tarball locations
+		path string
+
+		// Set for OCI layout locations, either may be empty
+		tag    string
+		digest string
+	}
+)
+
+const (
+	mutateLocationRegistry mutateLocationKind = iota
+	mutateLocationOCI
+	mutateLocationTarball
+	mutateLocationDockerDaemon
+)
+
+// Parse a source or destination, which is either a registry reference or one of
+// oci:<path>[:<tag>|@<digest>], tarball:<path>[:<tag>] or docker-daemon:<reference>.
+// The tag of a tarball is a full reference, e.g. "tarball:image.tar:example.com/app:v1".
+func mutateUtilParseLocation(s string, insecure bool) (*mutateLocation, error) {
+	location := &mutateLocation{raw: s}
+	switch {
+	case strings.HasPrefix(s, locationPrefixOCI):
+		location.kind = mutateLocationOCI
+		location.path = strings.TrimPrefix(s, locationPrefixOCI)
+		if i := strings.LastIndex(location.path, "@"); i != -1 {
+			location.digest = location.path[i+1:]
+			location.path = location.path[:i]
+			if _, err := v1.NewHash(location.digest); err != nil {
+				return nil, fmt.Errorf("parsing digest in %q: %v", s, err)
+			}
+		} else if i := strings.LastIndex(location.path, ":"); i > strings.LastIndex(location.path, "/") {
+			location.tag = location.path[i+1:]
+			location.path = location.path[:i]
+		}
+	case strings.HasPrefix(s, locationPrefixTarball):
+		location.kind = mutateLocationTarball
+		location.path = strings.TrimPrefix(s, locationPrefixTarball)
+		// Paths may contain colons too, so split at the first one followed by a
+		// reference with an explicit tag
+		for i := 0; i < len(location.path); i++ {
+			if location.path[i] != ':' {
+				continue
+			}
+			ref := location.path[i+1:]
+			if strings.LastIndex(ref, ":") <= strings.LastIndex(ref, "/") {
+				continue
+			}
+			if tag, err := name.NewTag(ref); err == nil {
+				location.ref = tag
+				location.path = location.path[:i]
+				break
+			}
+		}
+	case strings.HasPrefix(s, locationPrefixDockerDaemon):
+		location.kind = mutateLocationDockerDaemon
+		ref, err := name.ParseReference(strings.TrimPrefix(s, locationPrefixDockerDaemon))
+		if err != nil {
+			return nil, fmt.Errorf("parsing reference %q: %v", s, err)
+		}
+		location.ref = ref
+		return location, nil
+	default:
+		var nameOpts []name.Option
+		if insecure {
+			nameOpts = append(nameOpts, name.Insecure)
+		}
+		ref, err := name.ParseReference(s, nameOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("parsing reference %q: %v", s, err)
+		}
+		location.ref = ref
+		return location, nil
+	}
+	if location.path == "" {
+		return nil, fmt.Errorf("missing path in %q", s)
+	}
+	return location, nil
+}
+
+// Whether the location is a remote registry (to which auth and transport options apply)
+func (location *mutateLocation) isRegistry() bool {
+	return location.kind == mutateLocationRegistry
+}
+
+func (location *mutateLocation) String() string {
+	if location.isRegistry() {
+		return location.ref.String()
+	}
+	return location.raw
+}
+
+// Load the image or index from an OCI layout, selected by tag or digest
+// (or the only manifest in the layout if neither is given)
+func mutateUtilReadOCILayout(location *mutateLocation) (v1.Image, v1.ImageIndex, error) {
+	index, err := layout.ImageIndexFromPath(location.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	var found []v1.Descriptor
+	for _, desc := range manifest.Manifests {
+		switch {
+		case location.digest != "":
+			if desc.Digest.String() != location.digest {
+				continue
+			}
+		case location.tag != "":
+			if desc.Annotations[locationOCIRefNameAnnotation] != location.tag {
+				continue
+			}
+		}
+		found = append(found, desc)
+	}
+	if len(found) == 0 {
+		return nil, nil, fmt.Errorf("no matching manifest in layout %s", location.path)
+	}
+	if len(found) > 1 {
+		return nil, nil, fmt.Errorf("%d manifests in layout %s, specify a tag or digest", len(found), location.path)
+	}
+	if found[0].MediaType.IsIndex() {
+		ii, err := index.ImageIndex(found[0].Digest)
+		return nil, ii, err
+	}
+	img, err := index.Image(found[0].Digest)
+	return img, nil, err
+}
+
+// Write the image or index to an OCI layout (created if missing), replacing
+// any manifest previously written with the same tag
+func mutateUtilWriteOCILayout(location *mutateLocation, img v1.Image, ii v1.ImageIndex) error {
+	if location.digest != "" {
+		return fmt.Errorf("cannot write to a digest in layout %s", location.path)
+	}
+	p, err := layout.FromPath(location.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		p, err = layout.Write(location.path, empty.Index)
+	}
+	if err != nil {
+		return err
+	}
+	matcher := func(desc v1.Descriptor) bool {
+		return desc.Annotations[locationOCIRefNameAnnotation] == location.tag
+	}
+	var opts []layout.Option
+	if location.tag != "" {
+		opts = append(opts, layout.WithAnnotations(map[string]string{
+			locationOCIRefNameAnnotation: location.tag,
+		}))
+	}
+	if ii != nil {
+		return p.ReplaceIndex(ii, match.Matcher(matcher), opts...)
+	}
+	return p.ReplaceImage(img, match.Matcher(matcher), opts...)
+}
+
+// The tag for an image written to a tarball: the destination's tag if it has one,
+// otherwise the source's (for a tarball source without one, the tag of the image in it)
+func mutateUtilGetTarballRef(source *mutateLocation, destination *mutateLocation) (name.Reference, error) {
+	if destination.ref != nil {
+		return destination.ref, nil
+	}
+	if source.ref != nil {
+		return source.ref, nil
+	}
+	if source.kind == mutateLocationTarball {
+		manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) {
+			return os.Open(source.path)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading tarball manifest: %v", err)
+		}
+		if len(manifest) == 1 && len(manifest[0].RepoTags) > 0 {
+			return name.NewTag(manifest[0].RepoTags[0])
+		}
+	}
+	return nil, fmt.Errorf("no tag for %s, use %s<path>:<tag>", destination.String(), locationPrefixTarball)
+}
+
+// Write the image to a tarball as created by "docker save", via a temporary file
+// so that an image may be written back to the tarball it was read from
+func mutateUtilWriteTarball(location *mutateLocation, ref name.Reference, img v1.Image) error {
+	f, err := ioutil.TempFile(filepath.Dir(location.path), filepath.Base(location.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := tarball.Write(ref, img, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), location.path)
+}
+
+// Write the image to the local Docker daemon, which requires a tag
+func mutateUtilWriteDockerDaemon(ctx context.Context, location *mutateLocation, img v1.Image) error {
+	tag, ok := location.ref.(name.Tag)
+	if !ok {
+		return fmt.Errorf("cannot write to a digest in the docker daemon: %s", location.raw)
+	}
+	_, err := daemon.Write(tag, img, daemon.WithContext(ctx))
+	return err
+}
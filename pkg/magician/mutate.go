@@ -3,20 +3,29 @@ package magician
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
@@ -25,7 +34,25 @@ import (
 	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
 	"github.com/docker-credential-magic/docker-credential-magic/internal/embedded/helpers"
 	"github.com/docker-credential-magic/docker-credential-magic/internal/embedded/mappings"
-	"github.com/docker-credential-magic/docker-credential-magic/internal/types"
+	"github.com/docker-credential-magic/docker-credential-magic/pkg/magic"
+)
+
+var (
+	// Platform of images without one set in their config,
+	// and of the helpers at the top level of a helpers dir
+	defaultPlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	// ELF machine for each architecture (as named by Go and OCI platforms)
+	elfMachines = map[string]elf.Machine{
+		"386":      elf.EM_386,
+		"amd64":    elf.EM_X86_64,
+		"arm":      elf.EM_ARM,
+		"arm64":    elf.EM_AARCH64,
+		"mips64le": elf.EM_MIPS,
+		"ppc64le":  elf.EM_PPC64,
+		"riscv64":  elf.EM_RISCV,
+		"s390x":    elf.EM_S390,
+	}
 )
 
 type (
@@ -39,27 +66,70 @@ type (
 
 	// The following fields are configurable via options
 	mutateOperationConfigurable struct {
-		tag            string
-		userAgent      string
-		helpersDir     string
-		mappingsDir    string
-		includeHelpers []string
-		writer         io.Writer
+		tag               string
+		userAgent         string
+		helpersDir        string
+		mappingsDir       string
+		includeHelpers    []string
+		disablePathLookup bool
+		magicKeychain     bool
+		allowArchMismatch bool
+		skipUnsupported   bool
+		sbomFile          string
+		sbomAttach        bool
+		signer            Signer
+		provenanceFile    string
+		provenanceAttach  bool
+		platform          *v1.Platform
+		src               *mutateRegistryConfigurable
+		dst               *mutateRegistryConfigurable
+		writer            io.Writer
+	}
+
+	// Configurable per registry (i.e. separately for source and destination)
+	mutateRegistryConfigurable struct {
+		keychain       authn.Keychain
+		auth           authn.Authenticator
+		insecure       bool
+		caCertFiles    []string
+		clientCertFile string
+		clientKeyFile  string
+		transport      http.RoundTripper
 	}
 
 	// The following fields are *not* configurable via options,
 	// and are used to pass data between mutate steps
 	mutateOperationRuntime struct {
+		ctx              context.Context
 		source           string
 		logger           *log.Logger
-		destination      name.Reference
+		sourceLocation   *mutateLocation
+		destination      *mutateLocation
 		supportedHelpers []string
 		requestedHelpers []string
+		srcKeychain      authn.Keychain
+		dstKeychain      authn.Keychain
+		srcTransport     http.RoundTripper
+		dstTransport     http.RoundTripper
 		baseImage        v1.Image
 		newImage         v1.Image
+		baseIndex        v1.ImageIndex
+		newIndex         v1.ImageIndex
+		platform         *v1.Platform
+		plan             *MutatePlan
+		imagePlan        *MutatePlanImage
+		helpers          []mutateHelper
+		numUnmutated     int
+		startTime        time.Time
 	}
 
 	mutateStep func(o *mutateOperation) error
+
+	// Helper binaries are not available for the platform being built
+	mutateUnsupportedPlatformError struct {
+		helpers  []string
+		platform string
+	}
 )
 
 // MutateOptWithTag sets a custom tag to use for a mutate operation.
@@ -97,6 +167,229 @@ func MutateOptWithIncludeHelpers(includeHelpers []string) MutateOption {
 	}
 }
 
+// MutateOptWithDisablePathLookup configures magic in the new image to only use helpers
+// found in /opt/magic/bin, never falling back to $PATH, for a mutate operation.
+func MutateOptWithDisablePathLookup(disablePathLookup bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.disablePathLookup = disablePathLookup
+	}
+}
+
+// MutateOptWithMagicKeychain configures a mutate operation to resolve credentials for
+// pulling and pushing the same way magic does (using mappings and helpers found on the
+// local system), before falling back to the default Docker keychain.
+func MutateOptWithMagicKeychain(magicKeychain bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.magicKeychain = magicKeychain
+	}
+}
+
+// MutateOptWithSourceKeychain sets a keychain to use when pulling the source image
+// for a mutate operation.
+func MutateOptWithSourceKeychain(keychain authn.Keychain) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.keychain = keychain
+	}
+}
+
+// MutateOptWithDestinationKeychain sets a keychain to use when pushing the new image
+// for a mutate operation.
+func MutateOptWithDestinationKeychain(keychain authn.Keychain) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.dst.keychain = keychain
+	}
+}
+
+// MutateOptWithSourceAuth sets credentials (e.g. authn.Basic or authn.Bearer) to use
+// when pulling the source image for a mutate operation. This takes precedence over any keychain.
+func MutateOptWithSourceAuth(auth authn.Authenticator) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.auth = auth
+	}
+}
+
+// MutateOptWithDestinationAuth sets credentials (e.g. authn.Basic or authn.Bearer) to use
+// when pushing the new image for a mutate operation. This takes precedence over any keychain.
+func MutateOptWithDestinationAuth(auth authn.Authenticator) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.dst.auth = auth
+	}
+}
+
+// MutateOptWithInsecure allows plain HTTP and unverified TLS connections to both
+// the source and destination registries for a mutate operation.
+func MutateOptWithInsecure(insecure bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.insecure = insecure
+		operation.configurable.dst.insecure = insecure
+	}
+}
+
+// MutateOptWithSourceInsecure allows plain HTTP and unverified TLS connections to
+// the source registry for a mutate operation.
+func MutateOptWithSourceInsecure(insecure bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.insecure = insecure
+	}
+}
+
+// MutateOptWithDestinationInsecure allows plain HTTP and unverified TLS connections to
+// the destination registry for a mutate operation.
+func MutateOptWithDestinationInsecure(insecure bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.dst.insecure = insecure
+	}
+}
+
+// MutateOptWithCACertFile adds a PEM file of CA certificates to trust (in addition to the
+// system pool) for both the source and destination registries for a mutate operation.
+func MutateOptWithCACertFile(caCertFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.caCertFiles = append(operation.configurable.src.caCertFiles, caCertFile)
+		operation.configurable.dst.caCertFiles = append(operation.configurable.dst.caCertFiles, caCertFile)
+	}
+}
+
+// MutateOptWithSourceCACertFile adds a PEM file of CA certificates to trust (in addition to the
+// system pool) for the source registry for a mutate operation.
+func MutateOptWithSourceCACertFile(caCertFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.caCertFiles = append(operation.configurable.src.caCertFiles, caCertFile)
+	}
+}
+
+// MutateOptWithDestinationCACertFile adds a PEM file of CA certificates to trust (in addition to the
+// system pool) for the destination registry for a mutate operation.
+func MutateOptWithDestinationCACertFile(caCertFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.dst.caCertFiles = append(operation.configurable.dst.caCertFiles, caCertFile)
+	}
+}
+
+// MutateOptWithClientCert sets a PEM client certificate and key to present to both
+// the source and destination registries for a mutate operation.
+func MutateOptWithClientCert(certFile string, keyFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.clientCertFile = certFile
+		operation.configurable.src.clientKeyFile = keyFile
+		operation.configurable.dst.clientCertFile = certFile
+		operation.configurable.dst.clientKeyFile = keyFile
+	}
+}
+
+// MutateOptWithSourceClientCert sets a PEM client certificate and key to present to
+// the source registry for a mutate operation.
+func MutateOptWithSourceClientCert(certFile string, keyFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.clientCertFile = certFile
+		operation.configurable.src.clientKeyFile = keyFile
+	}
+}
+
+// MutateOptWithDestinationClientCert sets a PEM client certificate and key to present to
+// the destination registry for a mutate operation.
+func MutateOptWithDestinationClientCert(certFile string, keyFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.dst.clientCertFile = certFile
+		operation.configurable.dst.clientKeyFile = keyFile
+	}
+}
+
+// MutateOptWithTransport sets a custom transport to use with both the source and
+// destination registries for a mutate operation. This cannot be combined with CA or client certs.
+func MutateOptWithTransport(transport http.RoundTripper) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.transport = transport
+		operation.configurable.dst.transport = transport
+	}
+}
+
+// MutateOptWithSourceTransport sets a custom transport to use with the source registry
+// for a mutate operation. This cannot be combined with CA or client certs.
+func MutateOptWithSourceTransport(transport http.RoundTripper) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.src.transport = transport
+	}
+}
+
+// MutateOptWithDestinationTransport sets a custom transport to use with the destination registry
+// for a mutate operation. This cannot be combined with CA or client certs.
+func MutateOptWithDestinationTransport(transport http.RoundTripper) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.dst.transport = transport
+	}
+}
+
+// MutateOptWithPlatform selects a single platform to mutate for a mutate operation.
+// If the source is an image index, only the image for this platform is mutated and
+// pushed (as a single image). Helpers are taken from the matching platform subdirectory.
+func MutateOptWithPlatform(platform v1.Platform) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.platform = &platform
+	}
+}
+
+// MutateOptWithAllowArchMismatch logs a warning, rather than failing, if a helper binary
+// is not built for the platform of the image for a mutate operation.
+func MutateOptWithAllowArchMismatch(allowArchMismatch bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.allowArchMismatch = allowArchMismatch
+	}
+}
+
+// MutateOptWithSkipUnsupportedPlatforms keeps the images of an index for platforms
+// without all of the helpers as-is (with a warning), rather than failing, for a mutate
+// operation. It still fails if no platform in the index has all of the helpers.
+func MutateOptWithSkipUnsupportedPlatforms(skipUnsupported bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.skipUnsupported = skipUnsupported
+	}
+}
+
+// MutateOptWithSBOMFile writes an SPDX SBOM describing the helpers added to the new
+// image (or each image of an index) to the given file for a mutate operation.
+func MutateOptWithSBOMFile(sbomFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.sbomFile = sbomFile
+	}
+}
+
+// MutateOptWithSBOMAttach pushes an SPDX SBOM describing the helpers added to the new
+// image to the destination registry as an OCI referrer of it (an artifact whose subject
+// is the new image, also listed under the fallback tag "sha256-<digest>"), for a mutate operation.
+func MutateOptWithSBOMAttach(sbomAttach bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.sbomAttach = sbomAttach
+	}
+}
+
+// MutateOptWithSigner signs the new image (or index) with the given signer, and pushes the
+// signature next to it in the destination registry, tagged "sha256-<digest>.sig"
+// (so that it can be verified with "cosign verify"), for a mutate operation.
+func MutateOptWithSigner(signer Signer) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.signer = signer
+	}
+}
+
+// MutateOptWithProvenanceFile writes an in-toto SLSA provenance statement for the new image
+// (in a DSSE envelope, signed if MutateOptWithSigner is also set) to the given file
+// for a mutate operation.
+func MutateOptWithProvenanceFile(provenanceFile string) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.provenanceFile = provenanceFile
+	}
+}
+
+// MutateOptWithProvenanceAttach pushes an in-toto SLSA provenance statement for the new image
+// (in a DSSE envelope signed by MutateOptWithSigner, which is required) to the destination
+// registry as an OCI referrer of it, for a mutate operation.
+func MutateOptWithProvenanceAttach(provenanceAttach bool) MutateOption {
+	return func(operation *mutateOperation) {
+		operation.configurable.provenanceAttach = provenanceAttach
+	}
+}
+
 // MutateOptWithWriter sets an output writer to use for a mutate operation.
 func MutateOptWithWriter(writer io.Writer) MutateOption {
 	return func(operation *mutateOperation) {
@@ -107,14 +400,77 @@ func MutateOptWithWriter(writer io.Writer) MutateOption {
 // Mutate takes a remote source image, builds a new image with various
 // Docker credential helpers baked-in, then pushes it back to the registry
 // (at the same reference unless otherwise specified with MutateOptWithTag).
+//
+// The source and tag may also be an OCI layout ("oci:<path>[:<tag>]"),
+// a tarball ("tarball:<path>") or the local Docker daemon ("docker-daemon:<ref>").
 func Mutate(source string, options ...MutateOption) error {
+	return MutateWithContext(context.Background(), source, options...)
+}
+
+// MutateWithContext is like Mutate, but stops between steps (and aborts any
+// pull or push in progress) once the provided context is canceled or expires.
+func MutateWithContext(ctx context.Context, source string, options ...MutateOption) error {
+	_, err := mutateRun(ctx, source, false, options...)
+	return err
+}
+
+// Run a mutate operation, stopping short of pushing the new image if dryRun is set
+func mutateRun(ctx context.Context, source string, dryRun bool, options ...MutateOption) (*mutateOperation, error) {
+	operation := mutateUtilNewOperation(ctx, source, options...)
+
+	// Run each of the mutate steps in order
+	steps := []mutateStep{
+
+		// Prepopulate various runtime fields on the operation
+		mutateStepSetLogger,
+		mutateStepSetDestination,
+		mutateStepSetSupportedHelpers,
+		mutateStepSetRequestedHelpers,
+		mutateStepSetKeychains,
+		mutateStepSetTransports,
+
+		// Attempt to pull the base image (or index)
+		mutateStepPullBaseImage,
+
+		// Build new image (or image for each platform) with helpers, mappings, env vars, etc.
+		mutateStepBuildNewImage,
+
+		// Record the destination and digests of the new image(s)
+		mutateStepCompletePlan,
+	}
+	if !dryRun {
+		// Push the new image to remote, then write (or push) the SBOM describing it, sign it,
+		// and write (or push) its provenance
+		steps = append(steps, mutateStepPushNewImage, mutateStepWriteSBOM, mutateStepSignNewImage,
+			mutateStepWriteProvenance)
+	}
+	if err := mutateUtilRunSteps(operation, steps); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		operation.runtime.logger.Printf("Dry run, not pushing image to %s.\n",
+			operation.runtime.destination.String())
+	} else {
+		operation.runtime.logger.Println("Done.")
+	}
+	return operation, nil
+}
+
+// Create an operation with default settings, modified by the user-provided options
+func mutateUtilNewOperation(ctx context.Context, source string, options ...MutateOption) *mutateOperation {
 	// Create default operation object
 	operation := &mutateOperation{
 		configurable: &mutateOperationConfigurable{
+			src:    &mutateRegistryConfigurable{},
+			dst:    &mutateRegistryConfigurable{},
 			writer: ioutil.Discard,
 		},
 		runtime: &mutateOperationRuntime{
-			source: source,
+			ctx:       ctx,
+			source:    source,
+			plan:      &MutatePlan{Source: source},
+			startTime: time.Now(),
 		},
 	}
 
@@ -122,32 +478,24 @@ func Mutate(source string, options ...MutateOption) error {
 	for _, option := range options {
 		option(operation)
 	}
+	return operation
+}
 
-	// Run each of the mutate steps in order
-	for _, step := range []mutateStep{
-
-		// Prepopulate various runtime fields on the operation
-		mutateStepSetLogger,
-		mutateStepSetDestination,
-		mutateStepSetSupportedHelpers,
-		mutateStepSetRequestedHelpers,
-
-		// Attempt to pull the base image
-		mutateStepPullBaseImage,
-
-		// Build new image with helpers, mappings, env vars, etc.
-		mutateStepAppendImageLayer,
-		mutateStepUpdateImageConfig,
-
-		// Push the new image to remote
-		mutateStepPushNewImage,
-	} {
+// Run each of the steps in order, stopping early if the operation's context is done
+func mutateUtilRunSteps(operation *mutateOperation, steps []mutateStep) error {
+	ctx := operation.runtime.ctx
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("mutate stopped: %w", err)
+		}
 		if err := step(operation); err != nil {
+			// Make sure cancellation is detectable via errors.Is
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("mutate stopped: %w (%v)", ctxErr, err)
+			}
 			return err
 		}
 	}
-
-	operation.runtime.logger.Println("Done.")
 	return nil
 }
 
@@ -159,13 +507,31 @@ func mutateStepSetLogger(operation *mutateOperation) error {
 }
 
 func mutateStepSetDestination(operation *mutateOperation) error {
+	source, err := mutateUtilParseLocation(operation.runtime.source,
+		operation.configurable.src.insecure)
+	if err != nil {
+		return err
+	}
+	operation.runtime.sourceLocation = source
 	ref := operation.runtime.source
 	if operation.configurable.tag != "" {
 		ref = operation.configurable.tag
 	}
-	destination, err := name.ParseReference(ref)
+	destination, err := mutateUtilParseLocation(ref, operation.configurable.dst.insecure)
 	if err != nil {
-		return fmt.Errorf("parsing reference %q: %v", ref, err)
+		return err
+	}
+	if operation.configurable.sbomAttach && !destination.isRegistry() {
+		return fmt.Errorf("cannot attach an SBOM to %s, only to an image in a registry", destination.String())
+	}
+	if operation.configurable.signer != nil && !destination.isRegistry() {
+		return fmt.Errorf("cannot sign %s, only an image in a registry", destination.String())
+	}
+	if operation.configurable.provenanceAttach && !destination.isRegistry() {
+		return fmt.Errorf("cannot attach provenance to %s, only to an image in a registry", destination.String())
+	}
+	if operation.configurable.provenanceAttach && operation.configurable.signer == nil {
+		return fmt.Errorf("cannot attach unsigned provenance to %s, a signer is required", destination.String())
 	}
 	operation.runtime.destination = destination
 	return nil
@@ -218,63 +584,261 @@ func mutateStepSetRequestedHelpers(operation *mutateOperation) error {
 	return nil
 }
 
+func mutateStepSetKeychains(operation *mutateOperation) error {
+	keychain, err := mutateUtilGetDefaultKeychain(operation)
+	if err != nil {
+		return err
+	}
+	operation.runtime.srcKeychain = keychain
+	if operation.configurable.src.keychain != nil {
+		operation.runtime.srcKeychain = operation.configurable.src.keychain
+	}
+	operation.runtime.dstKeychain = keychain
+	if operation.configurable.dst.keychain != nil {
+		operation.runtime.dstKeychain = operation.configurable.dst.keychain
+	}
+	return nil
+}
+
+func mutateStepSetTransports(operation *mutateOperation) error {
+	srcTransport, err := mutateUtilGetTransport(operation.configurable.src)
+	if err != nil {
+		return fmt.Errorf("source transport: %v", err)
+	}
+	operation.runtime.srcTransport = srcTransport
+	dstTransport, err := mutateUtilGetTransport(operation.configurable.dst)
+	if err != nil {
+		return fmt.Errorf("destination transport: %v", err)
+	}
+	operation.runtime.dstTransport = dstTransport
+	return nil
+}
+
 func mutateStepPullBaseImage(operation *mutateOperation) error {
 	operation.runtime.logger.Printf("Pulling %s ...\n", operation.runtime.source)
-	baseImage, err := crane.Pull(operation.runtime.source)
+	source := operation.runtime.sourceLocation
+	switch source.kind {
+	case mutateLocationOCI:
+		baseImage, baseIndex, err := mutateUtilReadOCILayout(source)
+		if err != nil {
+			return fmt.Errorf("reading layout %q: %v", operation.runtime.source, err)
+		}
+		operation.runtime.baseImage = baseImage
+		operation.runtime.baseIndex = baseIndex
+		return nil
+	case mutateLocationTarball:
+		var tag *name.Tag
+		if t, ok := source.ref.(name.Tag); ok {
+			tag = &t
+		}
+		baseImage, err := tarball.ImageFromPath(source.path, tag)
+		if err != nil {
+			return fmt.Errorf("reading tarball %q: %v", operation.runtime.source, err)
+		}
+		operation.runtime.baseImage = baseImage
+		return nil
+	case mutateLocationDockerDaemon:
+		baseImage, err := daemon.Image(source.ref, daemon.WithContext(operation.runtime.ctx))
+		if err != nil {
+			return fmt.Errorf("reading from docker daemon %q: %v", operation.runtime.source, err)
+		}
+		operation.runtime.baseImage = baseImage
+		return nil
+	}
+	opts := mutateUtilGetRemoteOptions(operation, operation.runtime.srcKeychain,
+		operation.configurable.src.auth, operation.runtime.srcTransport)
+	desc, err := remote.Get(source.ref, opts...)
 	if err != nil {
 		return fmt.Errorf("pulling %q: %v", operation.runtime.source, err)
 	}
+	if desc.MediaType.IsIndex() {
+		baseIndex, err := desc.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("loading index %q: %v", operation.runtime.source, err)
+		}
+		operation.runtime.baseIndex = baseIndex
+		return nil
+	}
+	baseImage, err := desc.Image()
+	if err != nil {
+		return fmt.Errorf("loading image %q: %v", operation.runtime.source, err)
+	}
 	operation.runtime.baseImage = baseImage
 	return nil
 }
 
+func mutateStepBuildNewImage(operation *mutateOperation) error {
+	platform := operation.configurable.platform
+	if operation.runtime.baseIndex != nil {
+		if platform == nil {
+			return mutateUtilBuildNewIndex(operation, mutateUtilBuildNewImage)
+		}
+		if err := mutateUtilSelectPlatformImage(operation); err != nil {
+			return err
+		}
+	} else if platform != nil {
+		operation.runtime.platform = platform
+	} else {
+		imagePlatform, err := mutateUtilGetImagePlatform(operation.runtime.baseImage)
+		if err != nil {
+			return err
+		}
+		operation.runtime.platform = imagePlatform
+	}
+	return mutateUtilBuildNewImage(operation)
+}
+
+func mutateStepRemoveMagicLayer(operation *mutateOperation) error {
+	hasMagicLayer, err := mutateUtilHasMagicLayer(operation.runtime.baseImage)
+	if err != nil {
+		return err
+	}
+	if !hasMagicLayer {
+		return nil
+	}
+	operation.runtime.logger.Println("Replacing existing magic layer ...")
+	baseImage, err := mutateUtilRemoveMagicLayer(operation.runtime.baseImage)
+	if err != nil {
+		return fmt.Errorf("removing magic layer: %v", err)
+	}
+	unmutatedDigest, err := baseImage.Digest()
+	if err != nil {
+		return fmt.Errorf("unmutated image digest: %v", err)
+	}
+	operation.runtime.baseImage = baseImage
+	operation.runtime.imagePlan.UnmutatedDigest = unmutatedDigest.String()
+	return nil
+}
+
 func mutateStepAppendImageLayer(operation *mutateOperation) error {
 	var b bytes.Buffer
 	tw := tar.NewWriter(&b)
 
-	// Add the mappings files to tar, extracting the helper names as we go
+	// Load the mappings files, extracting the helper names as we go
+	var helperMappings []*magic.HelperMapping
 	var helperNames []string
 	for _, slug := range operation.runtime.requestedHelpers {
-		embeddedFilename, tarFilename := mutateUtilGetMappingsFilenamesBySlug(slug)
-		operation.runtime.logger.Printf("Adding /%s ...\n", tarFilename)
-		helperName, err := mutateUtilWriteEmbeddedFileToTar(embeddedFilename, tarFilename, tw, true,
-			operation.configurable.mappingsDir, operation.configurable.helpersDir)
+		embeddedFilename, _ := mutateUtilGetMappingsFilenamesBySlug(slug)
+		m, err := mutateUtilLoadMappingsFile(embeddedFilename, operation.configurable.mappingsDir)
 		if err != nil {
-			return fmt.Errorf("write mappings file %s to tar: %v", embeddedFilename, err)
+			return fmt.Errorf("load mappings file %s: %v", embeddedFilename, err)
+		}
+		helperMappings = append(helperMappings, m)
+		// The encrypted store is built into magic, so there is no binary to add
+		if m.Helper == constants.StoreHelper {
+			continue
 		}
-		helperNames = append(helperNames, helperName)
+		helperNames = append(helperNames, m.Helper)
 	}
 
 	// Add our magic helper to the list of helpers for the next step
 	helperNames = append(helperNames, constants.MagicCredentialSuffix)
 
-	// Add the helper binaries to tar
+	// Add the helper binaries to tar, recording the checksum (and version) of each
+	// (or all of the helpers missing for this platform)
+	checksums := map[string]string{}
+	operation.runtime.helpers = nil
+	var unsupported *mutateUnsupportedPlatformError
 	for _, helperName := range helperNames {
 		embeddedFilename, tarFilename := mutateUtilGetHelperFilenamesByName(helperName)
 		operation.runtime.logger.Printf("Adding /%s ...\n", tarFilename)
-		_, err := mutateUtilWriteEmbeddedFileToTar(embeddedFilename, tarFilename, tw, false,
-			operation.configurable.mappingsDir, operation.configurable.helpersDir)
+		checksum, err := mutateUtilWriteEmbeddedFileToTar(operation, embeddedFilename, tarFilename, tw)
+		var unsupportedErr *mutateUnsupportedPlatformError
+		if errors.As(err, &unsupportedErr) {
+			if unsupported == nil {
+				unsupported = &mutateUnsupportedPlatformError{platform: unsupportedErr.platform}
+			}
+			unsupported.helpers = append(unsupported.helpers, unsupportedErr.helpers...)
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("write helper file %s to tar: %v", embeddedFilename, err)
 		}
+		checksums[helperName] = checksum
+		helper := mutateHelper{name: helperName, sha256: checksum}
+		for _, m := range helperMappings {
+			if m.Helper == helperName {
+				helper.version, helper.url, helper.license = m.Version, m.URL, m.License
+			}
+		}
+		if helperName == constants.MagicCredentialSuffix {
+			helper.url, helper.license = constants.MagicURL, constants.MagicLicense
+		}
+		operation.runtime.helpers = append(operation.runtime.helpers, helper)
+	}
+	if unsupported != nil {
+		return unsupported
 	}
+	operation.runtime.imagePlan.helpers = operation.runtime.helpers
 
-	// Add our custom Docker config.json to tar
+	// Add the mappings files to tar, pinning each helper to the exact binary added above
+	for i, slug := range operation.runtime.requestedHelpers {
+		m := helperMappings[i]
+		if checksum, ok := checksums[m.Helper]; ok {
+			_, tarFilename := mutateUtilGetHelperFilenamesByName(m.Helper)
+			m.Path = fmt.Sprintf("/%s", tarFilename)
+			m.Sha256 = checksum
+		}
+		mb, err := yaml.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("encoding mappings for %s: %v", slug, err)
+		}
+		_, tarFilename := mutateUtilGetMappingsFilenamesBySlug(slug)
+		operation.runtime.logger.Printf("Adding /%s ...\n", tarFilename)
+		if err := mutateUtilWriteFileToTar(tarFilename, int64(len(mb)), bytes.NewReader(mb), tw); err != nil {
+			return err
+		}
+	}
+
+	// Add our magic settings file to tar
+	settings := magic.Settings{
+		HelpersDirs:       []string{fmt.Sprintf("%s/%s", constants.MagicRootDir, constants.BinariesSubdir)},
+		DisablePathLookup: operation.configurable.disablePathLookup,
+	}
+	sb, err := yaml.Marshal(&settings)
+	if err != nil {
+		return fmt.Errorf("encoding settings: %v", err)
+	}
 	name := fmt.Sprintf("%s/%s", strings.TrimPrefix(constants.MagicRootDir, "/"),
+		constants.SettingsFileBasename)
+	operation.runtime.logger.Printf("Adding /%s ...\n", name)
+	if err := mutateUtilWriteFileToTar(name, int64(len(sb)), bytes.NewReader(sb), tw); err != nil {
+		return err
+	}
+
+	// Add our custom Docker config.json to tar
+	name = fmt.Sprintf("%s/%s", strings.TrimPrefix(constants.MagicRootDir, "/"),
 		constants.DockerConfigFileBasename)
 	operation.runtime.logger.Printf("Adding /%s ...\n", name)
-	err := mutateUtilWriteFileToTar(name, int64(len(constants.DockerConfigFileContents)),
+	err = mutateUtilWriteFileToTar(name, int64(len(constants.DockerConfigFileContents)),
 		strings.NewReader(constants.DockerConfigFileContents), tw)
 	if err != nil {
 		return err
 	}
 
 	// Create and append new layer from tarball
+	files, err := mutateUtilGetPlanFiles(b.Bytes())
+	if err != nil {
+		return err
+	}
+	operation.runtime.imagePlan.Files = files
 	newLayer, err := tarball.LayerFromReader(&b)
 	if err != nil {
 		return fmt.Errorf("layer from reader: %v", err)
 	}
-	img, err := mutate.AppendLayers(operation.runtime.baseImage, newLayer)
+	// Record how the layer was created, dated like the base image so the result is reproducible
+	baseCfg, err := operation.runtime.baseImage.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("load image config: %v", err)
+	}
+	img, err := mutate.Append(operation.runtime.baseImage, mutate.Addendum{
+		Layer: newLayer,
+		History: v1.History{
+			Created:   baseCfg.Created,
+			CreatedBy: mutateUtilGetCreatedBy(operation),
+			Comment:   constants.MagicLayerComment,
+		},
+	})
 	if err != nil {
 		return fmt.Errorf("append layers: %v", err)
 	}
@@ -288,8 +852,12 @@ func mutateStepUpdateImageConfig(operation *mutateOperation) error {
 	if err != nil {
 		return fmt.Errorf("load image config: %v", err)
 	}
+	baseCfg := cfg
 	cfg = cfg.DeepCopy()
 
+	// Start from the env and labels of the image before any previous mutate
+	mutateUtilRestoreImageConfig(cfg)
+
 	// $PATH
 	newPath := fmt.Sprintf("%s/%s", constants.MagicRootDir, constants.BinariesSubdir)
 	operation.runtime.logger.Printf("Prepending %s with %s ...\n", constants.EnvVarPath, newPath)
@@ -318,27 +886,320 @@ func mutateStepUpdateImageConfig(operation *mutateOperation) error {
 		constants.EnvVarDockerCredentialMagicConfig, constants.MagicRootDir)
 	mutateUtilSetImageConfigEnvVar(cfg, constants.EnvVarDockerCredentialMagicConfig, constants.MagicRootDir)
 
+	operation.runtime.imagePlan.Env = mutateUtilGetPlanEnv(baseCfg, cfg)
+
+	// Provenance labels and annotations, tracing the new image back to its base
+	// (without magic, so that mutating an image again gives the same digest)
+	unmutatedDigest := operation.runtime.imagePlan.UnmutatedDigest
+	operation.runtime.logger.Println("Adding provenance labels and annotations ...")
+	if cfg.Config.Labels == nil {
+		cfg.Config.Labels = map[string]string{}
+	}
+	for k, v := range mutateUtilGetProvenanceLabels(operation, unmutatedDigest) {
+		cfg.Config.Labels[k] = v
+	}
 	operation.runtime.newImage, err = mutate.ConfigFile(operation.runtime.newImage, cfg)
 	if err != nil {
 		return fmt.Errorf("mutate config file: %v", err)
 	}
+	baseManifest, err := operation.runtime.baseImage.Manifest()
+	if err != nil {
+		return fmt.Errorf("base image manifest: %v", err)
+	}
+	annotations := mutateUtilGetProvenanceAnnotations(operation, unmutatedDigest, baseManifest.Annotations)
+	operation.runtime.newImage = mutate.Annotations(operation.runtime.newImage, annotations).(v1.Image)
+	return nil
+}
+
+func mutateStepCompletePlan(operation *mutateOperation) error {
+	plan := operation.runtime.plan
+	plan.Destination = operation.runtime.destination.String()
+	for _, imagePlan := range plan.Images {
+		digest, err := imagePlan.image.Digest()
+		if err != nil {
+			return fmt.Errorf("image digest for platform %s: %v", imagePlan.Platform, err)
+		}
+		imagePlan.Digest = digest.String()
+	}
+	if operation.runtime.newIndex != nil {
+		digest, err := operation.runtime.newIndex.Digest()
+		if err != nil {
+			return fmt.Errorf("index digest: %v", err)
+		}
+		plan.Digest = digest.String()
+		return nil
+	}
+	plan.Digest = plan.Images[0].Digest
 	return nil
 }
 
 func mutateStepPushNewImage(operation *mutateOperation) error {
-	operation.runtime.logger.Printf("Pushing image to %s ...\n",
-		operation.runtime.destination.String())
+	destination := operation.runtime.destination
+	operation.runtime.logger.Printf("Pushing image to %s ...\n", destination.String())
+	newImage, newIndex := operation.runtime.newImage, operation.runtime.newIndex
+	if newIndex != nil && (destination.kind == mutateLocationTarball ||
+		destination.kind == mutateLocationDockerDaemon) {
+		return fmt.Errorf("cannot write an image index to %s, select a platform", destination.String())
+	}
+	switch destination.kind {
+	case mutateLocationOCI:
+		if err := mutateUtilWriteOCILayout(destination, newImage, newIndex); err != nil {
+			return fmt.Errorf("layout write: %v", err)
+		}
+		return nil
+	case mutateLocationTarball:
+		ref, err := mutateUtilGetTarballRef(operation.runtime.sourceLocation, destination)
+		if err != nil {
+			return fmt.Errorf("tarball write: %v", err)
+		}
+		if err := mutateUtilWriteTarball(destination, ref, newImage); err != nil {
+			return fmt.Errorf("tarball write: %v", err)
+		}
+		return nil
+	case mutateLocationDockerDaemon:
+		if err := mutateUtilWriteDockerDaemon(operation.runtime.ctx, destination, newImage); err != nil {
+			return fmt.Errorf("daemon write: %v", err)
+		}
+		return nil
+	}
+	opts := mutateUtilGetRemoteOptions(operation, operation.runtime.dstKeychain,
+		operation.configurable.dst.auth, operation.runtime.dstTransport)
+	if newIndex != nil {
+		if err := remote.WriteIndex(destination.ref, newIndex, opts...); err != nil {
+			return fmt.Errorf("remote write index: %v", err)
+		}
+		return nil
+	}
+	if err := remote.Write(destination.ref, newImage, opts...); err != nil {
+		return fmt.Errorf("remote write: %v", err)
+	}
+	return nil
+}
+
+// Build the new image from the base image, for the current platform
+func mutateUtilBuildNewImage(operation *mutateOperation) error {
+	if err := mutateUtilCheckImagePlatform(operation.runtime.baseImage, operation.runtime.platform); err != nil {
+		return err
+	}
+	if err := mutateUtilStartImagePlan(operation); err != nil {
+		return err
+	}
+	for _, step := range []mutateStep{
+		mutateStepRemoveMagicLayer,
+		mutateStepAppendImageLayer,
+		mutateStepUpdateImageConfig,
+	} {
+		if err := step(operation); err != nil {
+			return err
+		}
+	}
+	operation.runtime.imagePlan.image = operation.runtime.newImage
+	return nil
+}
+
+func (err *mutateUnsupportedPlatformError) Error() string {
+	return fmt.Sprintf("no helpers %s found for platform %s", strings.Join(err.helpers, ", "), err.platform)
+}
+
+// Build a new index, with a new image (built by buildImage) for each linux platform in the
+// base index. Other manifests (e.g. windows images or attestations) are kept as-is. Fails
+// naming each platform without all of the helpers, unless these are to be skipped, in which
+// case their images are kept as-is (with a warning). Annotations on both the index and its
+// manifests are preserved.
+func mutateUtilBuildNewIndex(operation *mutateOperation, buildImage mutateStep) error {
+	baseIndex := operation.runtime.baseIndex
+	indexManifest, err := baseIndex.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("loading index manifest: %v", err)
+	}
+	keep := func(desc v1.Descriptor) (mutate.IndexAddendum, error) {
+		var add mutate.Appendable
+		var err error
+		if desc.MediaType.IsIndex() {
+			add, err = baseIndex.ImageIndex(desc.Digest)
+		} else {
+			add, err = baseIndex.Image(desc.Digest)
+		}
+		if err != nil {
+			return mutate.IndexAddendum{}, fmt.Errorf("loading manifest %s: %v", desc.Digest, err)
+		}
+		return mutate.IndexAddendum{Add: add, Descriptor: desc}, nil
+	}
+	var adds []mutate.IndexAddendum
+	var numMutated int
+	var unsupported []string
+	var unsupportedErrs []string
+	for _, desc := range indexManifest.Manifests {
+		if err := operation.runtime.ctx.Err(); err != nil {
+			return fmt.Errorf("mutate stopped: %w", err)
+		}
+		if !desc.MediaType.IsImage() || desc.Platform == nil || desc.Platform.OS != "linux" {
+			operation.runtime.logger.Printf("Keeping %s (%s) as-is ...\n",
+				desc.Digest, mutateUtilGetPlatformString(desc.Platform))
+			add, err := keep(desc)
+			if err != nil {
+				return err
+			}
+			adds = append(adds, add)
+			continue
+		}
+
+		platform := mutateUtilGetPlatformString(desc.Platform)
+		operation.runtime.logger.Printf("Building image for platform %s ...\n", platform)
+		baseImage, err := baseIndex.Image(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("loading image for platform %s: %v", platform, err)
+		}
+		operation.runtime.baseImage = baseImage
+		operation.runtime.platform = desc.Platform
+		numImages := len(operation.runtime.plan.Images)
+		if err := buildImage(operation); err != nil {
+			var unsupportedErr *mutateUnsupportedPlatformError
+			if !errors.As(err, &unsupportedErr) {
+				return fmt.Errorf("platform %s: %v", platform, err)
+			}
+			unsupportedErrs = append(unsupportedErrs, unsupportedErr.Error())
+			if !operation.configurable.skipUnsupported {
+				continue
+			}
+			operation.runtime.logger.Printf("Warning: %v, keeping %s (%s) as-is ...\n",
+				unsupportedErr, desc.Digest, platform)
+			operation.runtime.plan.Images = operation.runtime.plan.Images[:numImages]
+			add, err := keep(desc)
+			if err != nil {
+				return err
+			}
+			adds = append(adds, add)
+			unsupported = append(unsupported, platform)
+			continue
+		}
+		// Only carry over fields which don't depend on the image contents
+		adds = append(adds, mutate.IndexAddendum{
+			Add: operation.runtime.newImage,
+			Descriptor: v1.Descriptor{
+				MediaType:   desc.MediaType,
+				Platform:    desc.Platform,
+				URLs:        desc.URLs,
+				Annotations: desc.Annotations,
+			},
+		})
+		numMutated++
+	}
+	if len(unsupportedErrs) > 0 && !operation.configurable.skipUnsupported {
+		return fmt.Errorf("index %q has platforms without helpers: %s",
+			operation.runtime.source, strings.Join(unsupportedErrs, "; "))
+	}
+	if numMutated == 0 && len(unsupported) > 0 {
+		return fmt.Errorf("index %q does not contain any images for platforms with helpers (found %s)",
+			operation.runtime.source, strings.Join(unsupported, ", "))
+	}
+	if numMutated == 0 {
+		return fmt.Errorf("index %q does not contain any linux images", operation.runtime.source)
+	}
+	removeAll := func(v1.Descriptor) bool { return true }
+	operation.runtime.newIndex = mutate.AppendManifests(mutate.RemoveManifests(baseIndex, removeAll), adds...)
+	return nil
+}
+
+// Pick the image matching the requested platform out of the base index
+func mutateUtilSelectPlatformImage(operation *mutateOperation) error {
+	platform := operation.configurable.platform
+	indexManifest, err := operation.runtime.baseIndex.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("loading index manifest: %v", err)
+	}
+	for _, desc := range indexManifest.Manifests {
+		if !desc.MediaType.IsImage() || desc.Platform == nil ||
+			desc.Platform.OS != platform.OS || desc.Platform.Architecture != platform.Architecture ||
+			(platform.Variant != "" && desc.Platform.Variant != platform.Variant) {
+			continue
+		}
+		operation.runtime.logger.Printf("Selecting image for platform %s (%s) ...\n",
+			mutateUtilGetPlatformString(desc.Platform), desc.Digest)
+		baseImage, err := operation.runtime.baseIndex.Image(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("loading image for platform %s: %v",
+				mutateUtilGetPlatformString(desc.Platform), err)
+		}
+		operation.runtime.baseImage = baseImage
+		operation.runtime.platform = desc.Platform
+		return nil
+	}
+	return fmt.Errorf("index %q does not contain an image for platform %s",
+		operation.runtime.source, mutateUtilGetPlatformString(platform))
+}
+
+// Refuse to add helpers for one platform to an image configured for another
+func mutateUtilCheckImagePlatform(img v1.Image, platform *v1.Platform) error {
+	imagePlatform, err := mutateUtilGetImagePlatform(img)
+	if err != nil {
+		return err
+	}
+	if imagePlatform == nil || platform == nil {
+		return nil
+	}
+	if imagePlatform.OS != platform.OS || imagePlatform.Architecture != platform.Architecture {
+		return fmt.Errorf("image config is for platform %s, but helpers are for platform %s",
+			mutateUtilGetPlatformString(imagePlatform), mutateUtilGetPlatformString(platform))
+	}
+	return nil
+}
+
+// Remote options shared by pull and push
+func mutateUtilGetRemoteOptions(operation *mutateOperation, keychain authn.Keychain,
+	auth authn.Authenticator, transport http.RoundTripper) []remote.Option {
+	authOpt := remote.WithAuthFromKeychain(keychain)
+	if auth != nil {
+		authOpt = remote.WithAuth(auth)
+	}
 	opts := []remote.Option{
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		authOpt,
+		remote.WithTransport(transport),
+		remote.WithContext(operation.runtime.ctx),
 	}
 	if operation.configurable.userAgent != "" {
 		opts = append(opts, remote.WithUserAgent(operation.configurable.userAgent))
 	}
-	if err := remote.Write(operation.runtime.destination,
-		operation.runtime.newImage, opts...); err != nil {
-		return fmt.Errorf("remote write: %v", err)
+	return opts
+}
+
+// Determine the platform of an image from its config, or nil if not set
+func mutateUtilGetImagePlatform(img v1.Image) (*v1.Platform, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("load image config: %v", err)
 	}
-	return nil
+	if cfg.OS == "" && cfg.Architecture == "" {
+		return nil, nil
+	}
+	return &v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture}, nil
+}
+
+// Format a platform as e.g. "linux/arm/v7"
+func mutateUtilGetPlatformString(platform *v1.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+	parts := []string{platform.OS, platform.Architecture}
+	if platform.Variant != "" {
+		parts = append(parts, platform.Variant)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Name of the subdirectory (of the embedded helpers, or a custom helpers dir)
+// containing helpers for a platform, e.g. "linux-arm64" or "linux-arm-v7"
+func mutateUtilGetPlatformSubdir(platform *v1.Platform) string {
+	if platform == nil {
+		return mutateUtilGetPlatformSubdir(&defaultPlatform)
+	}
+	return strings.Join(strings.Split(mutateUtilGetPlatformString(platform), "/"), "-")
+}
+
+// Helpers for the default platform may also be found at the top level
+func mutateUtilIsDefaultPlatform(platform *v1.Platform) bool {
+	return platform == nil || (platform.OS == defaultPlatform.OS &&
+		platform.Architecture == defaultPlatform.Architecture)
 }
 
 func mutateUtilGetMappingsFilenamesBySlug(slug string) (string, string) {
@@ -359,30 +1220,67 @@ func mutateUtilGetHelperFilenamesByName(name string) (string, string) {
 	return embeddedFilename, tarFilename
 }
 
-// Grab embedded file by path "embeddedFilename" and add to the tar at "tarFilename".
-// If "mappingsDir" / "helpersDir" is provided, grab it from there instead.
-// If "isMapping" is true, then assume mappings file and attempt to extract helper name.
-func mutateUtilWriteEmbeddedFileToTar(embeddedFilename string, tarFilename string,
-	tw *tar.Writer, isMapping bool, mappingsDir string, helpersDir string) (string, error) {
+// Load and parse the embedded mappings file at "embeddedFilename".
+// If "mappingsDir" is provided, grab it from there instead.
+func mutateUtilLoadMappingsFile(embeddedFilename string, mappingsDir string) (*magic.HelperMapping, error) {
 	basename := path.Base(embeddedFilename)
 	var file fs.File
 	var err error
-	if isMapping {
-		if mappingsDir == "" {
-			file, err = mappings.Embedded.Open(embeddedFilename)
-		} else {
-			newPath := filepath.Join(mappingsDir, basename)
-			file, err = os.Open(newPath)
-		}
+	if mappingsDir == "" {
+		file, err = mappings.Embedded.Open(embeddedFilename)
 	} else {
+		newPath := filepath.Join(mappingsDir, basename)
+		file, err = os.Open(newPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening embedded file %s: %v", basename, err)
+	}
+	defer file.Close()
+
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("reader readall file %s: %v", basename, err)
+	}
+	var m magic.HelperMapping
+	err = yaml.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("parsing mappings for %s: %v", basename, err)
+	}
+	return &m, nil
+}
+
+// Grab embedded helper file by path "embeddedFilename" and add to the tar at "tarFilename".
+// If a helpers dir is configured, grab it from there instead. Helpers for the current
+// platform are taken from its subdirectory (see mutateUtilGetPlatformSubdir), or for the
+// default platform (linux/amd64), from the top level. Binaries must be ELF files built for
+// the current platform, unless mismatches are allowed (scripts are not checked).
+// Returns the sha256 digest (hex) of the file.
+func mutateUtilWriteEmbeddedFileToTar(operation *mutateOperation, embeddedFilename string,
+	tarFilename string, tw *tar.Writer) (string, error) {
+	helpersDir := operation.configurable.helpersDir
+	platform := operation.runtime.platform
+	basename := path.Base(embeddedFilename)
+	subdirs := []string{mutateUtilGetPlatformSubdir(platform)}
+	if mutateUtilIsDefaultPlatform(platform) {
+		subdirs = append(subdirs, "")
+	}
+	var file fs.File
+	var err error
+	for _, subdir := range subdirs {
 		// special case for "docker-credential-magic", always take from embedded
 		if helpersDir == "" || basename == fmt.Sprintf("%s-%s",
 			constants.DockerCredentialPrefix, constants.MagicCredentialSuffix) {
-			file, err = helpers.Embedded.Open(embeddedFilename)
+			file, err = helpers.Embedded.Open(path.Join(path.Dir(embeddedFilename), subdir, basename))
 		} else {
-			newPath := filepath.Join(helpersDir, basename)
+			newPath := filepath.Join(helpersDir, subdir, basename)
 			file, err = os.Open(newPath)
 		}
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", &mutateUnsupportedPlatformError{helpers: []string{basename}, platform: mutateUtilGetPlatformString(platform)}
 	}
 	if err != nil {
 		return "", fmt.Errorf("opening embedded file %s: %v", basename, err)
@@ -394,15 +1292,11 @@ func mutateUtilWriteEmbeddedFileToTar(embeddedFilename string, tarFilename strin
 		return "", fmt.Errorf("reader readall file %s: %v", basename, err)
 	}
 
-	// In the case of the mappings files, extract the helper name
-	var helper string
-	if isMapping {
-		var m types.HelperMapping
-		err = yaml.Unmarshal(b, &m)
-		if err != nil {
-			return "", fmt.Errorf("parsing mappings for %s: %v", basename, err)
+	if err := mutateUtilCheckHelperPlatform(b, platform); err != nil {
+		if !operation.configurable.allowArchMismatch {
+			return "", fmt.Errorf("helper %s: %v", basename, err)
 		}
-		helper = m.Helper
+		operation.runtime.logger.Printf("Warning: helper %s: %v\n", basename, err)
 	}
 
 	// Copy file into the tar
@@ -415,7 +1309,33 @@ func mutateUtilWriteEmbeddedFileToTar(embeddedFilename string, tarFilename strin
 		return "", err
 	}
 
-	return helper, nil
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Check that a helper binary is a Linux ELF file for the platform's architecture.
+// Scripts (starting with a shebang) can run anywhere, so are not checked.
+func mutateUtilCheckHelperPlatform(b []byte, platform *v1.Platform) error {
+	if bytes.HasPrefix(b, []byte("#!")) {
+		return nil
+	}
+	if platform == nil {
+		platform = &defaultPlatform
+	}
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("not an ELF binary, cannot run on platform %s", mutateUtilGetPlatformString(platform))
+	}
+	defer f.Close()
+	if platform.OS == "linux" && f.OSABI != elf.ELFOSABI_NONE && f.OSABI != elf.ELFOSABI_LINUX {
+		return fmt.Errorf("built for OS ABI %s, cannot run on platform %s",
+			f.OSABI, mutateUtilGetPlatformString(platform))
+	}
+	if machine, ok := elfMachines[platform.Architecture]; ok && f.Machine != machine {
+		return fmt.Errorf("built for machine %s, cannot run on platform %s",
+			f.Machine, mutateUtilGetPlatformString(platform))
+	}
+	return nil
 }
 
 func mutateUtilWriteFileToTar(filename string, size int64, reader io.Reader, tw *tar.Writer) error {
@@ -465,3 +1385,79 @@ func mutateUtilSetImageConfigEnvVar(cf *v1.ConfigFile, key string, val string) {
 		cf.Config.Env = append(cf.Config.Env, fmt.Sprintf("%s=%s", key, val))
 	}
 }
+
+func mutateUtilUnsetImageConfigEnvVar(cf *v1.ConfigFile, key string) {
+	if i, _ := mutateUtilGetImageConfigEnvVar(cf, key); i >= 0 {
+		cf.Config.Env = append(cf.Config.Env[:i], cf.Config.Env[i+1:]...)
+	}
+}
+
+// Build the transport for a registry, based on remote.DefaultTransport
+// unless a custom transport was provided
+func mutateUtilGetTransport(config *mutateRegistryConfigurable) (http.RoundTripper, error) {
+	if config.transport != nil {
+		if len(config.caCertFiles) > 0 || config.clientCertFile != "" {
+			return nil, fmt.Errorf("a custom transport cannot be combined with CA or client certificates")
+		}
+		return config.transport, nil
+	}
+	if !config.insecure && len(config.caCertFiles) == 0 && config.clientCertFile == "" {
+		return remote.DefaultTransport, nil
+	}
+	tlsConfig := &tls.Config{
+		// Only when explicitly requested
+		InsecureSkipVerify: config.insecure,
+	}
+	if len(config.caCertFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, filename := range config.caCertFiles {
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA cert file: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no PEM certificates found in %s", filename)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.clientCertFile, config.clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := remote.DefaultTransport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// The keychain used on both sides unless overridden: the default Docker keychain,
+// preceded by the magic keychain if enabled
+func mutateUtilGetDefaultKeychain(operation *mutateOperation) (authn.Keychain, error) {
+	if !operation.configurable.magicKeychain {
+		return authn.DefaultKeychain, nil
+	}
+	// Use the same mappings files that are added to the new image
+	resolverOpts := []magic.ResolverOption{
+		magic.ResolverOptWithWriter(operation.configurable.writer),
+	}
+	if operation.configurable.mappingsDir != "" {
+		resolverOpts = append(resolverOpts, magic.ResolverOptWithMappingsDir(operation.configurable.mappingsDir))
+	} else {
+		mappingsFS, err := fs.Sub(mappings.Embedded, constants.EmbeddedParentDir)
+		if err != nil {
+			return nil, fmt.Errorf("loading embedded mappings: %v", err)
+		}
+		resolverOpts = append(resolverOpts, magic.ResolverOptWithMappingsFS(mappingsFS))
+	}
+	keychain, err := magic.NewKeychain(resolverOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating magic keychain: %v", err)
+	}
+	return authn.NewMultiKeychain(keychain, authn.DefaultKeychain), nil
+}
@@ -2,13 +2,29 @@ package magician
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/elf"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -20,9 +36,14 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/phayes/freeport"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/crypto/bcrypt"
@@ -30,7 +51,7 @@ import (
 
 	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
 	"github.com/docker-credential-magic/docker-credential-magic/internal/embedded/mappings"
-	"github.com/docker-credential-magic/docker-credential-magic/internal/types"
+	"github.com/docker-credential-magic/docker-credential-magic/pkg/magic"
 )
 
 var (
@@ -107,9 +128,17 @@ func (suite *MutateTestSuite) SetupSuite() {
 		remote.WithAuthFromKeychain(authn.DefaultKeychain),
 	}
 
-	// Build test refs used in individual tests
+	// Build test refs used in individual tests, one for each test number (Test_<n>_...)
+	var numTests int
+	suiteType := reflect.TypeOf(suite)
+	for i := 0; i < suiteType.NumMethod(); i++ {
+		var n int
+		if _, err := fmt.Sscanf(suiteType.Method(i).Name, "Test_%d_", &n); err == nil && n >= numTests {
+			numTests = n + 1
+		}
+	}
 	var testReferences []*name.Reference
-	for i := range []int{0, 1, 2, 3} {
+	for i := 0; i < numTests; i++ {
 		ref, err := name.ParseReference(fmt.Sprintf("%s/magician:test%d", suite.DockerRegistryHost, i))
 		suite.Nil(err, fmt.Sprintf("parsing reference for test%d setup", i))
 		testReferences = append(testReferences, &ref)
@@ -170,6 +199,10 @@ func (suite *MutateTestSuite) Test_0_HappyPath() {
 		magicConfigFilename := fmt.Sprintf("%s/%s",
 			constants.MagicRootDir, constants.DockerConfigFileBasename)
 		suite.Contains(files, magicConfigFilename)
+
+		magicSettingsFilename := fmt.Sprintf("%s/%s",
+			constants.MagicRootDir, constants.SettingsFileBasename)
+		suite.Contains(files, magicSettingsFilename)
 	}
 
 	for _, env := range [][]string{envAlt, envReg} {
@@ -321,6 +354,27 @@ func (suite *MutateTestSuite) Test_3_CustomHelpersAndMappings() {
 		MutateOptWithIncludeHelpers([]string{"example"}))
 	suite.Nil(err, "test2 Mutate fails with valid custom dirs")
 
+	// The paths of the custom dirs are not recorded, so the digest does not depend on them
+	img, err = remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test2 pull fails")
+	cfg, err := img.ConfigFile()
+	suite.Nil(err, "test2 config")
+	createdBy := cfg.History[len(cfg.History)-1].CreatedBy
+	suite.Contains(createdBy, "--include example --helpers-dir <custom> --mappings-dir <custom>")
+	suite.NotContains(createdBy, "testdata")
+	digest, err := img.Digest()
+	suite.Nil(err, "test2 digest")
+	mappingsDir, err := filepath.Abs("../../testdata/mappings/valid")
+	suite.Nil(err, "test2 absolute mappings dir")
+	helpersDir, err := filepath.Abs("../../testdata/helpers")
+	suite.Nil(err, "test2 absolute helpers dir")
+	plan, err := Plan(ref.String(),
+		MutateOptWithMappingsDir(mappingsDir),
+		MutateOptWithHelpersDir(helpersDir),
+		MutateOptWithIncludeHelpers([]string{"example"}))
+	suite.Nil(err, "test2 Plan fails with absolute custom dirs")
+	suite.Equal(digest.String(), plan.Digest)
+
 	// Invalid (missing fields)
 	err = Mutate(ref.String(),
 		MutateOptWithMappingsDir("../../testdata/mappings/invalid-missing-fields"),
@@ -336,6 +390,1064 @@ func (suite *MutateTestSuite) Test_3_CustomHelpersAndMappings() {
 	suite.NotNil(err, "test2 Mutate does not fails with invalid custom dirs (bad yaml)")
 }
 
+func (suite *MutateTestSuite) Test_4_PinnedHelperChecksums() {
+	img := empty.Image
+	ref := *suite.TestReferences[4]
+	err := remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test4 setup")
+
+	err = Mutate(ref.String(),
+		MutateOptWithMappingsDir("../../testdata/mappings/valid"),
+		MutateOptWithHelpersDir("../../testdata/helpers"),
+		MutateOptWithIncludeHelpers([]string{"example"}),
+		MutateOptWithDisablePathLookup(true))
+	suite.Nil(err, "test4 Mutate fails with valid custom dirs")
+
+	mappingFilename := fmt.Sprintf("%s/%s/example.%s",
+		constants.MagicRootDir, constants.MappingsSubdir, constants.ExtensionYAML)
+	b, err := extractFile(ref.String(), mappingFilename)
+	suite.Nil(err, "test4 extracting mappings file")
+
+	var m magic.HelperMapping
+	err = yaml.Unmarshal(b, &m)
+	suite.Nil(err, "test4 parsing mappings file")
+
+	helper, err := ioutil.ReadFile("../../testdata/helpers/docker-credential-example")
+	suite.Nil(err, "test4 reading example helper")
+	sum := sha256.Sum256(helper)
+
+	suite.Equal("example", m.Helper)
+	suite.Equal([]string{"example.com"}, m.Domains)
+	suite.Equal(hex.EncodeToString(sum[:]), m.Sha256)
+	suite.Equal(fmt.Sprintf("%s/%s/%s-example", constants.MagicRootDir,
+		constants.BinariesSubdir, constants.DockerCredentialPrefix), m.Path)
+
+	settingsFilename := fmt.Sprintf("%s/%s", constants.MagicRootDir, constants.SettingsFileBasename)
+	b, err = extractFile(ref.String(), settingsFilename)
+	suite.Nil(err, "test4 extracting settings file")
+
+	var settings magic.Settings
+	err = yaml.Unmarshal(b, &settings)
+	suite.Nil(err, "test4 parsing settings file")
+	suite.Equal([]string{fmt.Sprintf("%s/%s", constants.MagicRootDir, constants.BinariesSubdir)},
+		settings.HelpersDirs)
+	suite.True(settings.DisablePathLookup)
+}
+
+func (suite *MutateTestSuite) Test_5_MagicKeychain() {
+	img := empty.Image
+	ref := *suite.TestReferences[5]
+	err := remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test5 setup")
+
+	// Hide the credentials from the default keychain, but make them
+	// available to magic (via its fallback config)
+	emptyDockerConfigDir, err := filepath.Abs(filepath.Join(suite.CacheRootDir, "test5-docker"))
+	suite.Nil(err, "test5 getting empty docker config absolute path")
+	os.Mkdir(emptyDockerConfigDir, 0700)
+	magicConfigDir, err := filepath.Abs(filepath.Join(suite.CacheRootDir, "test5-magic"))
+	suite.Nil(err, "test5 getting magic config absolute path")
+	os.Mkdir(magicConfigDir, 0700)
+	dockerConfigDir := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", emptyDockerConfigDir)
+	os.Setenv(constants.EnvVarDockerOrigConfig, dockerConfigDir)
+	os.Setenv(constants.EnvVarDockerCredentialMagicConfig, magicConfigDir)
+	defer func() {
+		os.Setenv("DOCKER_CONFIG", dockerConfigDir)
+		os.Unsetenv(constants.EnvVarDockerOrigConfig)
+		os.Unsetenv(constants.EnvVarDockerCredentialMagicConfig)
+	}()
+
+	err = Mutate(ref.String())
+	suite.NotNil(err, "test5 Mutate does not fail without credentials")
+
+	err = Mutate(ref.String(), MutateOptWithMagicKeychain(true))
+	suite.Nil(err, "test5 Mutate fails with magic keychain")
+}
+
+func (suite *MutateTestSuite) Test_6_SourceAndDestinationAuth() {
+	img := empty.Image
+	ref := *suite.TestReferences[6]
+	err := remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test6 setup")
+
+	validAuth := &authn.Basic{Username: testUsername, Password: testPassword}
+	invalidAuth := &authn.Basic{Username: testUsername, Password: "wrong"}
+	anonymous := authn.NewMultiKeychain()
+
+	err = Mutate(ref.String(), MutateOptWithSourceAuth(invalidAuth))
+	suite.NotNil(err, "test6 Mutate does not fail with invalid source auth")
+
+	err = Mutate(ref.String(), MutateOptWithDestinationAuth(invalidAuth))
+	suite.NotNil(err, "test6 Mutate does not fail with invalid destination auth")
+
+	err = Mutate(ref.String(), MutateOptWithSourceKeychain(anonymous))
+	suite.NotNil(err, "test6 Mutate does not fail with anonymous source keychain")
+
+	err = Mutate(ref.String(), MutateOptWithDestinationKeychain(anonymous))
+	suite.NotNil(err, "test6 Mutate does not fail with anonymous destination keychain")
+
+	// Explicit auth takes precedence over keychains
+	err = Mutate(ref.String(),
+		MutateOptWithSourceKeychain(anonymous),
+		MutateOptWithDestinationKeychain(anonymous),
+		MutateOptWithSourceAuth(validAuth),
+		MutateOptWithDestinationAuth(validAuth))
+	suite.Nil(err, "test6 Mutate fails with valid source and destination auth")
+}
+
+func (suite *MutateTestSuite) Test_7_TransportAndTLS() {
+	img := empty.Image
+	ref := *suite.TestReferences[7]
+	err := remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test7 setup")
+
+	srcTransport := &countingTransport{}
+	dstTransport := &countingTransport{}
+	err = Mutate(ref.String(),
+		MutateOptWithSourceTransport(srcTransport),
+		MutateOptWithDestinationTransport(dstTransport),
+		MutateOptWithInsecure(true))
+	suite.Nil(err, "test7 Mutate fails with custom transports")
+	suite.True(srcTransport.count > 0, "test7 source transport not used")
+	suite.True(dstTransport.count > 0, "test7 destination transport not used")
+
+	err = Mutate(ref.String(),
+		MutateOptWithTransport(&countingTransport{}),
+		MutateOptWithDestinationCACertFile("../../testdata/mappings/valid/example.yml"))
+	suite.NotNil(err, "test7 Mutate does not fail with custom transport and CA cert")
+
+	err = Mutate(ref.String(), MutateOptWithCACertFile("some/nonexistant/path"))
+	suite.NotNil(err, "test7 Mutate does not fail with missing CA cert file")
+
+	err = Mutate(ref.String(), MutateOptWithSourceCACertFile("../../testdata/mappings/valid/example.yml"))
+	suite.NotNil(err, "test7 Mutate does not fail with invalid CA cert file")
+
+	err = Mutate(ref.String(), MutateOptWithClientCert("some/nonexistant/path", "some/nonexistant/path"))
+	suite.NotNil(err, "test7 Mutate does not fail with missing client cert")
+}
+
+func (suite *MutateTestSuite) Test_8_Context() {
+	img := empty.Image
+	ref := *suite.TestReferences[8]
+	err := remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test8 setup")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = MutateWithContext(ctx, ref.String())
+	suite.True(errors.Is(err, context.Canceled), "test8 MutateWithContext does not fail with canceled context")
+
+	// Cancel once the push has started
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = MutateWithContext(ctx, ref.String(),
+		MutateOptWithDestinationTransport(&cancelingTransport{cancel: cancel}))
+	suite.True(errors.Is(err, context.Canceled), "test8 MutateWithContext does not fail when canceled during push")
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	err = MutateWithContext(ctx, ref.String())
+	suite.True(errors.Is(err, context.DeadlineExceeded), "test8 MutateWithContext does not fail with expired context")
+
+	err = MutateWithContext(context.Background(), ref.String())
+	suite.Nil(err, "test8 MutateWithContext fails with background context")
+}
+
+func (suite *MutateTestSuite) Test_9_ImageIndex() {
+	ref := *suite.TestReferences[9]
+	linuxImg, err := imageForPlatform("linux", "amd64")
+	suite.Nil(err, "test9 creating linux image")
+	windowsImg, err := imageForPlatform("windows", "amd64")
+	suite.Nil(err, "test9 creating windows image")
+	windowsDigest, err := windowsImg.Digest()
+	suite.Nil(err, "test9 getting windows image digest")
+
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{
+			Add: linuxImg,
+			Descriptor: v1.Descriptor{
+				Platform:    &v1.Platform{OS: "linux", Architecture: "amd64"},
+				Annotations: map[string]string{"org.example.manifest": "linux"},
+			},
+		},
+		mutate.IndexAddendum{
+			Add: windowsImg,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "windows", Architecture: "amd64"},
+			},
+		})
+	idx = mutate.Annotations(idx, map[string]string{"org.example.index": "test9"}).(v1.ImageIndex)
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write index for test9 setup")
+
+	err = Mutate(ref.String())
+	suite.Nil(err, "test9 Mutate fails with image index")
+
+	newIdx, err := remote.Index(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test9 pulling mutated index")
+	manifest, err := newIdx.IndexManifest()
+	suite.Nil(err, "test9 loading mutated index manifest")
+	suite.Equal("test9", manifest.Annotations["org.example.index"])
+	suite.Len(manifest.Manifests, 2)
+	suite.Equal("linux", manifest.Manifests[0].Platform.OS)
+	suite.Equal("linux", manifest.Manifests[0].Annotations["org.example.manifest"])
+	suite.Equal(windowsDigest, manifest.Manifests[1].Digest)
+
+	files, _, err := extractImage(fmt.Sprintf("%s@%s", ref.Context(), manifest.Manifests[0].Digest))
+	suite.Nil(err, "test9 extracting mutated linux image")
+	suite.Contains(files, fmt.Sprintf("%s/%s/%s-%s", constants.MagicRootDir, constants.BinariesSubdir,
+		constants.DockerCredentialPrefix, constants.MagicCredentialSuffix))
+
+	// Platform without helpers fails, naming the platform and its missing helpers
+	s390xImg, err := imageForPlatform("linux", "s390x")
+	suite.Nil(err, "test9 creating s390x image")
+	s390xDigest, err := s390xImg.Digest()
+	suite.Nil(err, "test9 getting s390x image digest")
+	s390xAdd := mutate.IndexAddendum{
+		Add:        s390xImg,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "s390x"}},
+	}
+	idx = mutate.AppendManifests(idx, s390xAdd)
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write index with s390x image for test9")
+	err = Mutate(ref.String())
+	suite.NotNil(err, "test9 Mutate does not fail with missing s390x helpers")
+	suite.Contains(err.Error(), "linux/s390x")
+	suite.Contains(err.Error(), "docker-credential-magic")
+
+	// Each platform is named, with all of its missing helpers
+	arm64Img, err := imageForPlatform("linux", "arm64")
+	suite.Nil(err, "test9 creating arm64 image")
+	arm64Idx := mutate.AppendManifests(idx, mutate.IndexAddendum{
+		Add:        arm64Img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+	})
+	err = remote.WriteIndex(ref, arm64Idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write index with arm64 image for test9")
+	err = Mutate(ref.String(), MutateOptWithIncludeHelpers([]string{"aws", "gcp"}))
+	suite.NotNil(err, "test9 Mutate does not fail with missing arm64 helpers")
+	suite.Contains(err.Error(), "no helpers docker-credential-ecr-login, docker-credential-gcr found for platform linux/arm64")
+	suite.Contains(err.Error(), "no helpers docker-credential-ecr-login, docker-credential-gcr, docker-credential-magic found for platform linux/s390x")
+
+	// Unless skipped, in which case they are kept as-is, with a warning
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write index with s390x image for test9")
+	var out bytes.Buffer
+	plan, err := Plan(ref.String(), MutateOptWithWriter(&out), MutateOptWithSkipUnsupportedPlatforms(true))
+	suite.Nil(err, "test9 Plan fails skipping missing s390x helpers")
+	suite.Len(plan.Images, 1)
+	suite.Equal("linux/amd64", plan.Images[0].Platform)
+	suite.Contains(out.String(), "Warning: no helpers")
+	suite.Contains(out.String(), "linux/s390x")
+	err = Mutate(ref.String(), MutateOptWithSkipUnsupportedPlatforms(true))
+	suite.Nil(err, "test9 Mutate fails skipping missing s390x helpers")
+	newIdx, err = remote.Index(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test9 pulling mutated index with s390x image")
+	manifest, err = newIdx.IndexManifest()
+	suite.Nil(err, "test9 loading mutated index manifest with s390x image")
+	suite.Len(manifest.Manifests, 3)
+	suite.Equal(windowsDigest, manifest.Manifests[1].Digest)
+	suite.Equal(s390xDigest, manifest.Manifests[2].Digest)
+
+	// Only platforms without helpers
+	idx = mutate.AppendManifests(empty.Index, s390xAdd)
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write s390x-only index for test9")
+	err = Mutate(ref.String(), MutateOptWithSkipUnsupportedPlatforms(true))
+	suite.NotNil(err, "test9 Mutate does not fail with s390x-only index")
+	suite.Contains(err.Error(), "linux/s390x")
+
+	// No linux images
+	idx = mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        windowsImg,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "windows", Architecture: "amd64"}},
+	})
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write windows-only index for test9")
+	err = Mutate(ref.String())
+	suite.NotNil(err, "test9 Mutate does not fail with windows-only index")
+}
+
+func (suite *MutateTestSuite) Test_10_Platform() {
+	ref := *suite.TestReferences[10]
+	amd64Img, err := imageForPlatform("linux", "amd64")
+	suite.Nil(err, "test10 creating amd64 image")
+	s390xImg, err := imageForPlatform("linux", "s390x")
+	suite.Nil(err, "test10 creating s390x image")
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{
+			Add:        amd64Img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		},
+		mutate.IndexAddendum{
+			Add:        s390xImg,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "s390x"}},
+		})
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write index for test10 setup")
+
+	err = Mutate(ref.String(), MutateOptWithPlatform(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+	suite.NotNil(err, "test10 Mutate does not fail with platform missing from index")
+
+	// Only the amd64 image is mutated (the s390x image has no helpers), and pushed as a single image
+	err = Mutate(ref.String(), MutateOptWithPlatform(v1.Platform{OS: "linux", Architecture: "amd64"}))
+	suite.Nil(err, "test10 Mutate fails selecting linux/amd64 from index")
+	desc, err := remote.Get(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test10 getting mutated image")
+	suite.True(desc.MediaType.IsImage(), "test10 mutated image is not an image")
+	newImg, err := desc.Image()
+	suite.Nil(err, "test10 loading mutated image")
+	cfg, err := newImg.ConfigFile()
+	suite.Nil(err, "test10 loading mutated image config")
+	suite.Equal("amd64", cfg.Architecture)
+
+	// Helpers for a different platform than the image config
+	err = Mutate(ref.String(), MutateOptWithPlatform(v1.Platform{OS: "linux", Architecture: "s390x"}))
+	suite.NotNil(err, "test10 Mutate does not fail with mismatched platform")
+	suite.Contains(err.Error(), "linux/amd64")
+
+	// Index descriptor which does not match the image config
+	idx = mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        s390xImg,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	})
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write mismatched index for test10")
+	err = Mutate(ref.String())
+	suite.NotNil(err, "test10 Mutate does not fail with mismatched index descriptor")
+}
+
+func (suite *MutateTestSuite) Test_11_HelperArchitecture() {
+	img := empty.Image
+	ref := *suite.TestReferences[11]
+	err := remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test11 setup")
+
+	helpersDir := filepath.Join(suite.CacheRootDir, "test11-helpers")
+	os.Mkdir(helpersDir, 0755)
+	helperFilename := filepath.Join(helpersDir, fmt.Sprintf("%s-example", constants.DockerCredentialPrefix))
+	opts := []MutateOption{
+		MutateOptWithMappingsDir("../../testdata/mappings/valid"),
+		MutateOptWithHelpersDir(helpersDir),
+		MutateOptWithIncludeHelpers([]string{"example"}),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		valid   bool
+	}{
+		{"amd64", elfHeader(elf.EM_X86_64), true},
+		{"script", []byte("#!/bin/sh\necho hello\n"), true},
+		{"arm64", elfHeader(elf.EM_AARCH64), false},
+		{"mach-o", []byte{0xcf, 0xfa, 0xed, 0xfe, 0x07, 0x00, 0x00, 0x01}, false},
+	} {
+		err = ioutil.WriteFile(helperFilename, tc.content, 0755)
+		suite.Nil(err, fmt.Sprintf("test11 writing %s helper", tc.name))
+		err = Mutate(ref.String(), opts...)
+		if tc.valid {
+			suite.Nil(err, fmt.Sprintf("test11 Mutate fails with %s helper", tc.name))
+			continue
+		}
+		suite.NotNil(err, fmt.Sprintf("test11 Mutate does not fail with %s helper", tc.name))
+		err = Mutate(ref.String(), append(opts, MutateOptWithAllowArchMismatch(true))...)
+		suite.Nil(err, fmt.Sprintf("test11 Mutate fails with %s helper when allowing mismatch", tc.name))
+	}
+}
+
+func (suite *MutateTestSuite) Test_12_LocalLocations() {
+	ref := *suite.TestReferences[12]
+	err := remote.Write(ref, empty.Image, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test12 setup")
+
+	// Registry to a new OCI layout
+	layoutDir := filepath.Join(suite.CacheRootDir, "test12-layout")
+	err = Mutate(ref.String(), MutateOptWithTag(fmt.Sprintf("oci:%s:v1", layoutDir)))
+	suite.Nil(err, "test12 Mutate fails writing to layout")
+	idx, err := layout.ImageIndexFromPath(layoutDir)
+	suite.Nil(err, "test12 reading layout")
+	manifest, err := idx.IndexManifest()
+	suite.Nil(err, "test12 reading layout index")
+	suite.Len(manifest.Manifests, 1)
+	suite.Equal("v1", manifest.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+
+	// Writing the same tag again replaces the manifest
+	err = Mutate(ref.String(), MutateOptWithTag(fmt.Sprintf("oci:%s:v1", layoutDir)))
+	suite.Nil(err, "test12 Mutate fails writing to layout again")
+	manifest, err = idx.IndexManifest()
+	suite.Nil(err, "test12 reading layout index again")
+	suite.Len(manifest.Manifests, 1)
+
+	// OCI layout to a tarball, which needs a tag
+	tarballPath := filepath.Join(suite.CacheRootDir, "test12.tar")
+	err = Mutate(fmt.Sprintf("oci:%s:v1", layoutDir), MutateOptWithTag("tarball:"+tarballPath))
+	suite.NotNil(err, "test12 Mutate does not fail writing layout to tarball without a tag")
+	err = Mutate(fmt.Sprintf("oci:%s:v1", layoutDir), MutateOptWithTag("tarball:"+tarballPath+":example.com/test12:v1"))
+	suite.Nil(err, "test12 Mutate fails writing layout to tarball")
+
+	// Tarball mutated in place keeps its tag
+	err = Mutate("tarball:" + tarballPath)
+	suite.Nil(err, "test12 Mutate fails writing tarball in place")
+	tarballManifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return os.Open(tarballPath)
+	})
+	suite.Nil(err, "test12 reading tarball manifest")
+	suite.Len(tarballManifest, 1)
+	suite.Equal([]string{"example.com/test12:v1"}, tarballManifest[0].RepoTags)
+	img, err := tarball.ImageFromPath(tarballPath, nil)
+	suite.Nil(err, "test12 reading tarball")
+	layers, err := img.Layers()
+	suite.Nil(err, "test12 reading tarball layers")
+	suite.NotEmpty(layers)
+
+	// Tarball selected by tag, and written with another one
+	err = Mutate("tarball:"+tarballPath+":example.com/test12:v1",
+		MutateOptWithTag("tarball:"+tarballPath+":example.com/test12:v2"))
+	suite.Nil(err, "test12 Mutate fails retagging tarball")
+	tarballManifest, err = tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return os.Open(tarballPath)
+	})
+	suite.Nil(err, "test12 reading retagged tarball manifest")
+	suite.Equal([]string{"example.com/test12:v2"}, tarballManifest[0].RepoTags)
+	err = Mutate("tarball:" + tarballPath + ":example.com/test12:v1")
+	suite.NotNil(err, "test12 Mutate does not fail with missing tarball tag")
+
+	// Tarball back to the registry
+	err = Mutate("tarball:"+tarballPath, MutateOptWithTag(ref.String()))
+	suite.Nil(err, "test12 Mutate fails writing tarball to registry")
+
+	// Missing tag
+	err = Mutate(fmt.Sprintf("oci:%s:nope", layoutDir))
+	suite.NotNil(err, "test12 Mutate does not fail with missing layout tag")
+
+	// An index can only be written to a tarball for a single platform
+	amd64Img, err := imageForPlatform("linux", "amd64")
+	suite.Nil(err, "test12 creating amd64 image")
+	p, err := layout.FromPath(layoutDir)
+	suite.Nil(err, "test12 loading layout")
+	err = p.AppendIndex(mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        amd64Img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	}), layout.WithAnnotations(map[string]string{"org.opencontainers.image.ref.name": "index"}))
+	suite.Nil(err, "test12 appending index to layout")
+	err = Mutate(fmt.Sprintf("oci:%s:index", layoutDir), MutateOptWithTag("tarball:"+tarballPath))
+	suite.NotNil(err, "test12 Mutate does not fail writing index to tarball")
+	err = Mutate(fmt.Sprintf("oci:%s:index", layoutDir), MutateOptWithTag("tarball:"+tarballPath+":test12:index"),
+		MutateOptWithPlatform(v1.Platform{OS: "linux", Architecture: "amd64"}))
+	suite.Nil(err, "test12 Mutate fails writing platform image from index to tarball")
+}
+
+func (suite *MutateTestSuite) Test_13_DryRun() {
+	ref := *suite.TestReferences[13]
+	img, err := mutate.Config(empty.Image, v1.Config{Env: []string{"PATH=/usr/bin"}})
+	suite.Nil(err, "test13 setting config")
+	err = remote.Write(ref, img, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test13 setup")
+	baseDigest, err := img.Digest()
+	suite.Nil(err, "test13 base digest")
+
+	newRef, err := name.ParseReference(ref.String() + "-new")
+	suite.Nil(err, "test13 parsing new reference")
+
+	plan, err := Plan(ref.String(), MutateOptWithTag(newRef.String()))
+	suite.Nil(err, "test13 Plan fails")
+	suite.Equal(newRef.String(), plan.Destination)
+	suite.Len(plan.Images, 1)
+	suite.Equal("linux/amd64", plan.Images[0].Platform)
+	suite.Equal(baseDigest.String(), plan.Images[0].BaseDigest)
+	suite.Equal(plan.Digest, plan.Images[0].Digest)
+
+	// Every file in the magic layer is listed, with the checksum of its contents
+	var found bool
+	for _, file := range plan.Images[0].Files {
+		if file.Path == "/opt/magic/config.json" {
+			found = true
+			sum := sha256.Sum256([]byte(constants.DockerConfigFileContents))
+			suite.Equal(hex.EncodeToString(sum[:]), file.Sha256)
+			suite.Equal(int64(len(constants.DockerConfigFileContents)), file.Size)
+		}
+		suite.Equal("0555", file.Mode)
+	}
+	suite.True(found, "test13 config.json missing from plan")
+
+	suite.Len(plan.Images[0].Env, 4)
+	suite.Equal(MutatePlanEnvVar{Name: "PATH", Old: "/usr/bin", New: "/opt/magic/bin:/usr/bin"},
+		plan.Images[0].Env[0])
+	suite.False(plan.Images[0].Env[2].Changed(), "test13 DOCKER_ORIG_CONFIG changed")
+
+	// Nothing is pushed
+	_, err = remote.Get(newRef, suite.RemoteOpts...)
+	suite.NotNil(err, "test13 Plan pushed an image")
+
+	// The plan matches what is then pushed
+	err = Mutate(ref.String(), MutateOptWithTag(newRef.String()))
+	suite.Nil(err, "test13 Mutate fails")
+	desc, err := remote.Get(newRef, suite.RemoteOpts...)
+	suite.Nil(err, "test13 getting pushed image")
+	suite.Equal(plan.Digest, desc.Digest.String())
+}
+
+func (suite *MutateTestSuite) Test_14_Remutate() {
+	ref := *suite.TestReferences[14]
+	layer, err := random.Layer(256, types.DockerLayer)
+	suite.Nil(err, "test14 creating random layer")
+	base, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: layer, History: v1.History{CreatedBy: "base layer"}},
+		mutate.Addendum{History: v1.History{CreatedBy: "base env", EmptyLayer: true}})
+	suite.Nil(err, "test14 appending base layer")
+	base, err = mutate.Config(base, v1.Config{Env: []string{"PATH=/usr/bin", "DOCKER_CONFIG=/etc/docker"}})
+	suite.Nil(err, "test14 setting base config")
+	err = remote.Write(ref, base, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test14 setup")
+
+	// Mutating twice gives the same image as mutating once
+	err = Mutate(ref.String())
+	suite.Nil(err, "test14 Mutate fails")
+	once, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test14 getting image mutated once")
+	onceDigest, err := once.Digest()
+	suite.Nil(err, "test14 digest of image mutated once")
+	err = Mutate(ref.String())
+	suite.Nil(err, "test14 Mutate fails a second time")
+	twice, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test14 getting image mutated twice")
+	twiceDigest, err := twice.Digest()
+	suite.Nil(err, "test14 digest of image mutated twice")
+	suite.Equal(onceDigest, twiceDigest)
+
+	// Removing the magic layer gives back the base image
+	stripped, err := mutateUtilRemoveMagicLayer(twice)
+	suite.Nil(err, "test14 removing magic layer")
+	strippedLayers, err := stripped.Layers()
+	suite.Nil(err, "test14 stripped layers")
+	suite.Len(strippedLayers, 1)
+	strippedCfg, err := stripped.ConfigFile()
+	suite.Nil(err, "test14 stripped config")
+	suite.Len(strippedCfg.History, 2)
+	suite.Equal("base env", strippedCfg.History[1].CreatedBy)
+
+	// Images mutated before the magic layer was marked are detected by their contents
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	err = mutateUtilWriteFileToTar("opt/magic/bin/docker-credential-magic", 5, strings.NewReader("magic"), tw)
+	suite.Nil(err, "test14 writing old magic layer")
+	oldLayer, err := tarball.LayerFromReader(&b)
+	suite.Nil(err, "test14 creating old magic layer")
+	old, err := mutate.AppendLayers(base, oldLayer)
+	suite.Nil(err, "test14 appending old magic layer")
+	old, err = mutate.Config(old, v1.Config{Env: []string{
+		"PATH=/opt/magic/bin:/opt/magic/bin:/usr/bin",
+		"DOCKER_CONFIG=/opt/magic",
+		"DOCKER_ORIG_CONFIG=/etc/docker",
+		"DOCKER_CREDENTIAL_MAGIC_CONFIG=/opt/magic",
+	}})
+	suite.Nil(err, "test14 setting old magic config")
+	err = remote.Write(ref, old, suite.RemoteOpts...)
+	suite.Nil(err, "remote write of old magic image for test14")
+	err = Mutate(ref.String())
+	suite.Nil(err, "test14 Mutate fails with old magic image")
+	_, env, err := extractImage(ref.String())
+	suite.Nil(err, "test14 extracting image")
+	suite.Contains(env, "PATH=/opt/magic/bin:/usr/bin")
+	suite.Contains(env, "DOCKER_ORIG_CONFIG=/etc/docker")
+	img, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test14 getting image mutated from old magic image")
+	imgLayers, err := img.Layers()
+	suite.Nil(err, "test14 layers of image mutated from old magic image")
+	suite.Len(imgLayers, 2)
+}
+
+func (suite *MutateTestSuite) Test_15_Unmutate() {
+	ref := *suite.TestReferences[15]
+	layer, err := random.Layer(256, types.DockerLayer)
+	suite.Nil(err, "test15 creating random layer")
+	base, err := mutate.AppendLayers(empty.Image, layer)
+	suite.Nil(err, "test15 appending base layer")
+	base, err = mutate.Config(base, v1.Config{Env: []string{"PATH=/usr/bin", "DOCKER_CONFIG=/etc/docker"}})
+	suite.Nil(err, "test15 setting base config")
+	baseDigest, err := base.Digest()
+	suite.Nil(err, "test15 base digest")
+	err = remote.Write(ref, base, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test15 setup")
+
+	err = Unmutate(ref.String())
+	suite.NotNil(err, "test15 Unmutate does not fail without magic layer")
+
+	// Unmutating a mutated image gives back the base image
+	err = Mutate(ref.String())
+	suite.Nil(err, "test15 Mutate fails")
+	cleanRef, err := name.ParseReference(ref.String() + "-clean")
+	suite.Nil(err, "test15 parsing clean reference")
+	err = Unmutate(ref.String(), MutateOptWithTag(cleanRef.String()))
+	suite.Nil(err, "test15 Unmutate fails")
+	clean, err := remote.Image(cleanRef, suite.RemoteOpts...)
+	suite.Nil(err, "test15 getting clean image")
+	cfg, err := clean.ConfigFile()
+	suite.Nil(err, "test15 clean image config")
+	suite.Equal([]string{"PATH=/usr/bin", "DOCKER_CONFIG=/etc/docker"}, cfg.Config.Env)
+	cleanDigest, err := clean.Digest()
+	suite.Nil(err, "test15 clean image digest")
+	suite.Equal(baseDigest, cleanDigest)
+
+	// Only the mutated images of an index are changed
+	s390xImg, err := imageForPlatform("linux", "s390x")
+	suite.Nil(err, "test15 creating s390x image")
+	mutated, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test15 getting mutated image")
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{
+			Add:        mutated,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		},
+		mutate.IndexAddendum{
+			Add:        s390xImg,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "s390x"}},
+		})
+	err = remote.WriteIndex(ref, idx, suite.RemoteOpts...)
+	suite.Nil(err, "remote write index for test15")
+	err = Unmutate(ref.String())
+	suite.Nil(err, "test15 Unmutate fails with index")
+	newIdx, err := remote.Index(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test15 getting unmutated index")
+	manifest, err := newIdx.IndexManifest()
+	suite.Nil(err, "test15 unmutated index manifest")
+	suite.Len(manifest.Manifests, 2)
+	suite.Equal(baseDigest, manifest.Manifests[0].Digest)
+	s390xDigest, err := s390xImg.Digest()
+	suite.Nil(err, "test15 s390x image digest")
+	suite.Equal(s390xDigest, manifest.Manifests[1].Digest)
+}
+
+func (suite *MutateTestSuite) Test_16_Inspect() {
+	ref := *suite.TestReferences[16]
+	err := remote.Write(ref, empty.Image, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test16 setup")
+
+	result, err := Inspect(ref.String())
+	suite.Nil(err, "test16 Inspect fails without magic")
+	suite.Len(result.Images, 1)
+	suite.False(result.Images[0].Magic, "test16 magic found in base image")
+
+	err = Mutate(ref.String(), MutateOptWithIncludeHelpers([]string{"aws"}),
+		MutateOptWithUserAgent("docker-credential-magician/v1.2.3"))
+	suite.Nil(err, "test16 Mutate fails")
+	result, err = Inspect(ref.String())
+	suite.Nil(err, "test16 Inspect fails")
+	suite.Len(result.Images, 1)
+	image := result.Images[0]
+	suite.True(image.Magic, "test16 magic not found")
+	suite.Equal("linux/amd64", image.Platform)
+	suite.Equal("docker-credential-magician/v1.2.3", image.MagicianVersion)
+
+	helpers := map[string]InspectHelper{}
+	for _, helper := range image.Helpers {
+		helpers[helper.Name] = helper
+	}
+	suite.Len(helpers, 2)
+	suite.Contains(helpers, "magic")
+	suite.Contains(helpers, "ecr-login")
+	suite.Equal("/opt/magic/bin/docker-credential-ecr-login", helpers["ecr-login"].Path)
+
+	suite.Len(image.Mappings, 1)
+	suite.Equal("aws", image.Mappings[0].Slug)
+	suite.Equal("ecr-login", image.Mappings[0].Helper)
+	suite.Equal([]string{"amazonaws.com", "ecr.aws"}, image.Mappings[0].Domains)
+	suite.Equal(helpers["ecr-login"].Sha256, image.Mappings[0].Sha256)
+
+	suite.Contains(image.Env, InspectEnvVar{Name: "DOCKER_CONFIG", Value: "/opt/magic"})
+	suite.Contains(image.Env, InspectEnvVar{Name: "DOCKER_CREDENTIAL_MAGIC_CONFIG", Value: "/opt/magic"})
+}
+
+func (suite *MutateTestSuite) Test_17_Provenance() {
+	ref := *suite.TestReferences[17]
+	err := remote.Write(ref, empty.Image, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test17 setup")
+	baseDigest, err := empty.Image.Digest()
+	suite.Nil(err, "test17 base digest")
+
+	err = Mutate(ref.String(), MutateOptWithIncludeHelpers([]string{"aws"}),
+		MutateOptWithUserAgent("docker-credential-magician/v1.2.3"))
+	suite.Nil(err, "test17 Mutate fails")
+
+	img, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test17 pull fails")
+	cfg, err := img.ConfigFile()
+	suite.Nil(err, "test17 config")
+	labels := cfg.Config.Labels
+	suite.Equal(ref.String(), labels[constants.LabelSource])
+	suite.Equal(baseDigest.String(), labels[constants.LabelSourceDigest])
+	suite.Equal("docker-credential-magician/v1.2.3", labels[constants.LabelVersion])
+	helpers := strings.Split(labels[constants.LabelHelpers], ",")
+	suite.Len(helpers, 2)
+	suite.True(strings.HasPrefix(helpers[0], "ecr-login:0.5.0@sha256:"), "test17 ecr-login helper: %s", helpers[0])
+	suite.True(strings.HasPrefix(helpers[1], "magic@sha256:"), "test17 magic helper: %s", helpers[1])
+
+	manifest, err := img.Manifest()
+	suite.Nil(err, "test17 manifest")
+	suite.Equal(ref.String(), manifest.Annotations[constants.AnnotationBaseName])
+	suite.Equal(baseDigest.String(), manifest.Annotations[constants.AnnotationBaseDigest])
+	suite.Equal(labels[constants.LabelHelpers], manifest.Annotations[constants.AnnotationHelpers])
+	suite.Equal("docker-credential-magician/v1.2.3", manifest.Annotations[constants.AnnotationVersion])
+	suite.NotContains(manifest.Annotations, constants.LabelHelpers)
+	suite.NotContains(manifest.Annotations, constants.AnnotationOrigBaseName)
+
+	suite.Len(cfg.History, 1)
+	suite.Equal(fmt.Sprintf("docker-credential-magician/v1.2.3 mutate %s --include aws", ref.String()),
+		cfg.History[0].CreatedBy)
+	suite.Equal(constants.MagicLayerComment, cfg.History[0].Comment)
+
+	// Provenance of the base is kept when mutating again, and removed when unmutating
+	err = Mutate(ref.String(), MutateOptWithIncludeHelpers([]string{"gcp"}))
+	suite.Nil(err, "test17 second Mutate fails")
+	img, err = remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test17 pull fails")
+	cfg, err = img.ConfigFile()
+	suite.Nil(err, "test17 config")
+	suite.Equal(baseDigest.String(), cfg.Config.Labels[constants.LabelSourceDigest])
+	suite.True(strings.HasPrefix(cfg.Config.Labels[constants.LabelHelpers], "gcr:2.1.0@sha256:"))
+
+	err = Unmutate(ref.String())
+	suite.Nil(err, "test17 Unmutate fails")
+	img, err = remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test17 pull fails")
+	digest, err := img.Digest()
+	suite.Nil(err, "test17 digest")
+	suite.Equal(baseDigest, digest)
+
+	// An image changed after mutating is rebuilt without magic as an image which was never
+	// pulled: the plan records both digests, and the new image the rebuilt one
+	err = Mutate(ref.String())
+	suite.Nil(err, "test17 Mutate fails")
+	img, err = remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test17 pull fails")
+	cfg, err = img.ConfigFile()
+	suite.Nil(err, "test17 config")
+	cfg = cfg.DeepCopy()
+	cfg.Config.Labels["org.example.label"] = "test17"
+	changedImg, err := mutate.ConfigFile(img, cfg)
+	suite.Nil(err, "test17 changing config")
+	changedDigest, err := changedImg.Digest()
+	suite.Nil(err, "test17 changed digest")
+	err = remote.Write(ref, changedImg, suite.RemoteOpts...)
+	suite.Nil(err, "remote write changed image for test17")
+	unmutatedImg, err := mutateUtilRemoveMagicLayer(changedImg)
+	suite.Nil(err, "test17 removing magic layer")
+	unmutatedDigest, err := unmutatedImg.Digest()
+	suite.Nil(err, "test17 unmutated digest")
+	suite.NotEqual(baseDigest, unmutatedDigest)
+	plan, err := Plan(ref.String())
+	suite.Nil(err, "test17 Plan fails with changed image")
+	suite.Equal(changedDigest.String(), plan.Images[0].BaseDigest)
+	suite.Equal(unmutatedDigest.String(), plan.Images[0].UnmutatedDigest)
+	err = Mutate(ref.String())
+	suite.Nil(err, "test17 Mutate fails with changed image")
+	img, err = remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test17 pull fails")
+	digest, err = img.Digest()
+	suite.Nil(err, "test17 digest")
+	suite.Equal(plan.Digest, digest.String())
+	cfg, err = img.ConfigFile()
+	suite.Nil(err, "test17 config")
+	suite.Equal(unmutatedDigest.String(), cfg.Config.Labels[constants.LabelSourceDigest])
+	manifest, err = img.Manifest()
+	suite.Nil(err, "test17 manifest")
+	suite.Equal(unmutatedDigest.String(), manifest.Annotations[constants.AnnotationBaseDigest])
+
+	// Base annotations set by the builder of the base are saved, and restored when unmutating
+	builderAnnotations := map[string]string{
+		constants.AnnotationBaseName:   "example.com/builder-base:1",
+		constants.AnnotationBaseDigest: "sha256:" + strings.Repeat("a", 64),
+		"org.example.annotation":       "test17",
+	}
+	annotatedImg := mutate.Annotations(empty.Image, builderAnnotations).(v1.Image)
+	annotatedDigest, err := annotatedImg.Digest()
+	suite.Nil(err, "test17 annotated base digest")
+	err = remote.Write(ref, annotatedImg, suite.RemoteOpts...)
+	suite.Nil(err, "remote write annotated base for test17")
+	for i := 0; i < 2; i++ {
+		err = Mutate(ref.String())
+		suite.Nil(err, "test17 Mutate fails with annotated base")
+		img, err = remote.Image(ref, suite.RemoteOpts...)
+		suite.Nil(err, "test17 pull fails")
+		manifest, err = img.Manifest()
+		suite.Nil(err, "test17 manifest with annotated base")
+		suite.Equal(ref.String(), manifest.Annotations[constants.AnnotationBaseName])
+		suite.Equal(annotatedDigest.String(), manifest.Annotations[constants.AnnotationBaseDigest])
+		suite.Equal("example.com/builder-base:1", manifest.Annotations[constants.AnnotationOrigBaseName])
+		suite.Equal(builderAnnotations[constants.AnnotationBaseDigest], manifest.Annotations[constants.AnnotationOrigBaseDigest])
+		suite.Equal("test17", manifest.Annotations["org.example.annotation"])
+	}
+	err = Unmutate(ref.String())
+	suite.Nil(err, "test17 Unmutate fails with annotated base")
+	img, err = remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test17 pull fails")
+	manifest, err = img.Manifest()
+	suite.Nil(err, "test17 unmutated manifest with annotated base")
+	suite.Equal(builderAnnotations, manifest.Annotations)
+	digest, err = img.Digest()
+	suite.Nil(err, "test17 digest")
+	suite.Equal(annotatedDigest, digest)
+}
+
+func (suite *MutateTestSuite) Test_18_SBOM() {
+	ref := *suite.TestReferences[18]
+	err := remote.Write(ref, empty.Image, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test18 setup")
+
+	sbomFile := filepath.Join(suite.CacheRootDir, "test18-sbom.json")
+	err = Mutate(ref.String(), MutateOptWithIncludeHelpers([]string{"aws"}),
+		MutateOptWithUserAgent("docker-credential-magician/v1.2.3"),
+		MutateOptWithSBOMFile(sbomFile), MutateOptWithSBOMAttach(true))
+	suite.Nil(err, "test18 Mutate fails")
+
+	b, err := ioutil.ReadFile(sbomFile)
+	suite.Nil(err, "test18 SBOM file not written")
+	var doc spdxDocument
+	err = json.Unmarshal(b, &doc)
+	suite.Nil(err, "test18 SBOM file is not valid JSON")
+	suite.Equal("SPDX-2.2", doc.SPDXVersion)
+	suite.Equal([]string{"Tool: docker-credential-magician/v1.2.3"}, doc.CreationInfo.Creators)
+
+	img, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test18 pull fails")
+	digest, err := img.Digest()
+	suite.Nil(err, "test18 digest")
+	packages := map[string]spdxPackage{}
+	for _, pkg := range doc.Packages {
+		packages[pkg.Name] = pkg
+	}
+	suite.Len(packages, 3)
+	suite.Equal(digest.String(), packages[ref.String()].VersionInfo)
+	suite.Equal("0.5.0", packages["docker-credential-ecr-login"].VersionInfo)
+	suite.Equal("Apache-2.0", packages["docker-credential-ecr-login"].LicenseDeclared)
+	suite.Equal("https://github.com/awslabs/amazon-ecr-credential-helper",
+		packages["docker-credential-ecr-login"].DownloadLocation)
+	suite.Equal("v1.2.3", packages["docker-credential-magic"].VersionInfo)
+	cfg, err := img.ConfigFile()
+	suite.Nil(err, "test18 config")
+	suite.True(strings.HasPrefix(cfg.Config.Labels[constants.LabelHelpers], fmt.Sprintf("ecr-login:0.5.0@sha256:%s",
+		packages["docker-credential-ecr-login"].Checksums[0].ChecksumValue)))
+	suite.Len(doc.Relationships, 3)
+
+	// The attached SBOM is the same document, referring to the new image as its subject
+	// and listed under the referrers fallback tag
+	indexDesc, err := remote.Get(ref.Context().Tag(fmt.Sprintf("sha256-%s", digest.Hex)), suite.RemoteOpts...)
+	suite.Nil(err, "test18 referrers index not found")
+	var index referrerIndex
+	err = json.Unmarshal(indexDesc.Manifest, &index)
+	suite.Nil(err, "test18 referrers index is not valid JSON")
+	suite.Equal(types.OCIImageIndex, index.MediaType)
+	suite.Len(index.Manifests, 1)
+	suite.Equal("text/spdx+json", index.Manifests[0].ArtifactType)
+	sbomDesc, err := remote.Get(ref.Context().Digest(index.Manifests[0].Digest.String()), suite.RemoteOpts...)
+	suite.Nil(err, "test18 attached SBOM not found")
+	var sbomManifest referrerManifest
+	err = json.Unmarshal(sbomDesc.Manifest, &sbomManifest)
+	suite.Nil(err, "test18 attached SBOM is not valid JSON")
+	suite.Equal("text/spdx+json", sbomManifest.ArtifactType)
+	suite.NotNil(sbomManifest.Subject, "test18 attached SBOM has no subject")
+	suite.Equal(digest, sbomManifest.Subject.Digest)
+	suite.Equal(types.MediaType("application/vnd.oci.empty.v1+json"), sbomManifest.Config.MediaType)
+	suite.Len(sbomManifest.Layers, 1)
+	suite.Equal(types.MediaType("text/spdx+json"), sbomManifest.Layers[0].MediaType)
+	layer, err := remote.Layer(ref.Context().Digest(sbomManifest.Layers[0].Digest.String()), suite.RemoteOpts...)
+	suite.Nil(err, "test18 SBOM layer")
+	rc, err := layer.Uncompressed()
+	suite.Nil(err, "test18 SBOM layer")
+	attached, err := ioutil.ReadAll(rc)
+	rc.Close()
+	suite.Nil(err, "test18 SBOM layer")
+	suite.Equal(b, attached)
+
+	// Attaching only works with a registry
+	layoutDir := filepath.Join(suite.CacheRootDir, "test18-layout")
+	err = Mutate(ref.String(), MutateOptWithTag(fmt.Sprintf("oci:%s", layoutDir)), MutateOptWithSBOMAttach(true))
+	suite.NotNil(err, "test18 Mutate does not fail attaching SBOM to a layout")
+}
+
+func (suite *MutateTestSuite) Test_19_Sign() {
+	ref := *suite.TestReferences[19]
+	err := remote.Write(ref, empty.Image, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test19 setup")
+
+	// Sign with an ECDSA key, then with an ed25519 key (mutating again gives the same digest)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Nil(err, "test19 generate ECDSA key")
+	ed25519PublicKey, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	suite.Nil(err, "test19 generate ed25519 key")
+	for i, key := range []interface{}{ecdsaKey, ed25519Key} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		suite.Nil(err, "test19 marshal key")
+		keyFile := filepath.Join(suite.CacheRootDir, fmt.Sprintf("test19-key-%d.pem", i))
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		suite.Nil(err, "test19 write key")
+		signer, err := NewSignerFromKeyFile(keyFile)
+		suite.Nil(err, "test19 load key")
+		err = Mutate(ref.String(), MutateOptWithSigner(signer))
+		suite.Nil(err, "test19 Mutate fails")
+	}
+
+	img, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test19 pull fails")
+	digest, err := img.Digest()
+	suite.Nil(err, "test19 digest")
+	sigImg, err := remote.Image(ref.Context().Tag(fmt.Sprintf("sha256-%s.sig", digest.Hex)), suite.RemoteOpts...)
+	suite.Nil(err, "test19 signature not found")
+	manifest, err := sigImg.Manifest()
+	suite.Nil(err, "test19 signature manifest")
+	suite.Len(manifest.Layers, 2)
+	layers, err := sigImg.Layers()
+	suite.Nil(err, "test19 signature layers")
+	for i, layer := range layers {
+		desc := manifest.Layers[i]
+		suite.Equal(types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json"), desc.MediaType)
+		rc, err := layer.Uncompressed()
+		suite.Nil(err, "test19 signature layer")
+		payload, err := ioutil.ReadAll(rc)
+		rc.Close()
+		suite.Nil(err, "test19 signature layer")
+		var p simpleSigningPayload
+		err = json.Unmarshal(payload, &p)
+		suite.Nil(err, "test19 payload is not valid JSON")
+		suite.Equal(digest.String(), p.Critical.Image.DockerManifestDigest)
+		suite.Equal(ref.Context().Name(), p.Critical.Identity.DockerReference)
+		suite.Equal("cosign container image signature", p.Critical.Type)
+
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations["dev.cosignproject.cosign/signature"])
+		suite.Nil(err, "test19 signature annotation")
+		if i == 0 {
+			sum := sha256.Sum256(payload)
+			suite.True(ecdsa.VerifyASN1(&ecdsaKey.PublicKey, sum[:], sig), "test19 ECDSA signature does not verify")
+		} else {
+			suite.True(ed25519.Verify(ed25519PublicKey, payload, sig), "test19 ed25519 signature does not verify")
+		}
+	}
+
+	// Bad keys, and signing anything other than an image in a registry
+	badKeyFile := filepath.Join(suite.CacheRootDir, "test19-bad-key.pem")
+	err = ioutil.WriteFile(badKeyFile, []byte("not a key"), 0600)
+	suite.Nil(err, "test19 write bad key")
+	_, err = NewSignerFromKeyFile(badKeyFile)
+	suite.NotNil(err, "test19 no error loading bad key")
+	signer := &keySigner{key: ecdsaKey}
+	layoutDir := filepath.Join(suite.CacheRootDir, "test19-layout")
+	err = Mutate(ref.String(), MutateOptWithTag(fmt.Sprintf("oci:%s", layoutDir)), MutateOptWithSigner(signer))
+	suite.NotNil(err, "test19 Mutate does not fail signing a layout")
+}
+
+func (suite *MutateTestSuite) Test_20_ProvenanceAttestation() {
+	ref := *suite.TestReferences[20]
+	err := remote.Write(ref, empty.Image, suite.RemoteOpts...)
+	suite.Nil(err, "remote write for test20 setup")
+	baseDigest, err := empty.Image.Digest()
+	suite.Nil(err, "test20 base digest")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Nil(err, "test20 generate key")
+	provenanceFile := filepath.Join(suite.CacheRootDir, "test20-provenance.json")
+	err = Mutate(ref.String(), MutateOptWithIncludeHelpers([]string{"aws"}),
+		MutateOptWithUserAgent("docker-credential-magician/v1.2.3"),
+		MutateOptWithSigner(&keySigner{key: key}),
+		MutateOptWithProvenanceFile(provenanceFile), MutateOptWithProvenanceAttach(true))
+	suite.Nil(err, "test20 Mutate fails")
+
+	b, err := ioutil.ReadFile(provenanceFile)
+	suite.Nil(err, "test20 provenance file not written")
+	var envelope dsseEnvelope
+	err = json.Unmarshal(b, &envelope)
+	suite.Nil(err, "test20 provenance file is not valid JSON")
+	suite.Equal("application/vnd.in-toto+json", envelope.PayloadType)
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	suite.Nil(err, "test20 provenance payload")
+	suite.Len(envelope.Signatures, 1)
+	sig, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+	suite.Nil(err, "test20 provenance signature")
+	sum := sha256.Sum256([]byte(fmt.Sprintf("DSSEv1 %d %s %d %s",
+		len(envelope.PayloadType), envelope.PayloadType, len(payload), payload)))
+	suite.True(ecdsa.VerifyASN1(&key.PublicKey, sum[:], sig), "test20 provenance signature does not verify")
+
+	var statement inTotoStatement
+	err = json.Unmarshal(payload, &statement)
+	suite.Nil(err, "test20 statement is not valid JSON")
+	suite.Equal("https://in-toto.io/Statement/v0.1", statement.Type)
+	suite.Equal("https://slsa.dev/provenance/v0.2", statement.PredicateType)
+	img, err := remote.Image(ref, suite.RemoteOpts...)
+	suite.Nil(err, "test20 pull fails")
+	digest, err := img.Digest()
+	suite.Nil(err, "test20 digest")
+	suite.Equal([]inTotoSubject{{Name: ref.Context().Name(), Digest: map[string]string{"sha256": digest.Hex}}},
+		statement.Subject)
+	suite.Equal("docker-credential-magician/v1.2.3", statement.Predicate.Builder.ID)
+	suite.Equal([]string{"aws"}, statement.Predicate.Invocation.Parameters.Helpers)
+	suite.Equal(ref.String(), statement.Predicate.Invocation.Parameters.Source)
+
+	materials := map[string]map[string]string{}
+	for _, material := range statement.Predicate.Materials {
+		materials[material.URI] = material.Digest
+	}
+	suite.Len(materials, 3)
+	suite.Equal(map[string]string{"sha256": baseDigest.Hex}, materials[ref.String()])
+	suite.Contains(materials, "pkg:generic/docker-credential-magic@v1.2.3")
+	cfg, err := img.ConfigFile()
+	suite.Nil(err, "test20 config")
+	suite.True(strings.HasPrefix(cfg.Config.Labels[constants.LabelHelpers], fmt.Sprintf("ecr-login:0.5.0@sha256:%s",
+		materials["pkg:generic/docker-credential-ecr-login@0.5.0"]["sha256"])))
+
+	// The attached attestation is the same envelope, referring to the new image as its subject
+	indexDesc, err := remote.Get(ref.Context().Tag(fmt.Sprintf("sha256-%s", digest.Hex)), suite.RemoteOpts...)
+	suite.Nil(err, "test20 referrers index not found")
+	var index referrerIndex
+	err = json.Unmarshal(indexDesc.Manifest, &index)
+	suite.Nil(err, "test20 referrers index is not valid JSON")
+	suite.Len(index.Manifests, 1)
+	suite.Equal("application/vnd.in-toto+json", index.Manifests[0].ArtifactType)
+	suite.Equal("https://slsa.dev/provenance/v0.2", index.Manifests[0].Annotations["predicateType"])
+	attDesc, err := remote.Get(ref.Context().Digest(index.Manifests[0].Digest.String()), suite.RemoteOpts...)
+	suite.Nil(err, "test20 attestation not found")
+	var manifest referrerManifest
+	err = json.Unmarshal(attDesc.Manifest, &manifest)
+	suite.Nil(err, "test20 attestation manifest")
+	suite.NotNil(manifest.Subject, "test20 attestation has no subject")
+	suite.Equal(digest, manifest.Subject.Digest)
+	suite.Len(manifest.Layers, 1)
+	suite.Equal(types.MediaType("application/vnd.dsse.envelope.v1+json"), manifest.Layers[0].MediaType)
+	layer, err := remote.Layer(ref.Context().Digest(manifest.Layers[0].Digest.String()), suite.RemoteOpts...)
+	suite.Nil(err, "test20 attestation layer")
+	rc, err := layer.Uncompressed()
+	suite.Nil(err, "test20 attestation layer")
+	attached, err := ioutil.ReadAll(rc)
+	rc.Close()
+	suite.Nil(err, "test20 attestation layer")
+	suite.Equal(bytes.TrimSpace(b), attached)
+
+	// Attaching requires a signer
+	err = Mutate(ref.String(), MutateOptWithProvenanceAttach(true))
+	suite.NotNil(err, "test20 Mutate does not fail attaching unsigned provenance")
+
+	// The paths of custom dirs are not recorded
+	mappingsDir, err := filepath.Abs("../../testdata/mappings/valid")
+	suite.Nil(err, "test20 absolute mappings dir")
+	helpersDir, err := filepath.Abs("../../testdata/helpers")
+	suite.Nil(err, "test20 absolute helpers dir")
+	err = Mutate(ref.String(), MutateOptWithTag(fmt.Sprintf("oci:%s", filepath.Join(suite.CacheRootDir, "test20-layout"))),
+		MutateOptWithMappingsDir(mappingsDir), MutateOptWithHelpersDir(helpersDir),
+		MutateOptWithIncludeHelpers([]string{"example"}), MutateOptWithProvenanceFile(provenanceFile))
+	suite.Nil(err, "test20 Mutate fails with custom dirs")
+	b, err = ioutil.ReadFile(provenanceFile)
+	suite.Nil(err, "test20 provenance file not written")
+	err = json.Unmarshal(b, &envelope)
+	suite.Nil(err, "test20 provenance file is not valid JSON")
+	payload, err = base64.StdEncoding.DecodeString(envelope.Payload)
+	suite.Nil(err, "test20 provenance payload")
+	suite.NotContains(string(payload), "testdata")
+	err = json.Unmarshal(payload, &statement)
+	suite.Nil(err, "test20 statement is not valid JSON")
+	suite.Equal("<custom>", statement.Predicate.Invocation.Parameters.HelpersDir)
+	suite.Equal("<custom>", statement.Predicate.Invocation.Parameters.MappingsDir)
+}
+
 func (suite *MutateTestSuite) Test_3_BadInput() {
 	badRefStr := fmt.Sprintf("%s/magician:::::woo!", suite.DockerRegistryHost)
 	err := Mutate(badRefStr)
@@ -369,7 +1481,7 @@ func getSlugHelperMap() (map[string]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		var m types.HelperMapping
+		var m magic.HelperMapping
 		err = yaml.Unmarshal(b, &m)
 		if err != nil {
 			return nil, err
@@ -379,6 +1491,53 @@ func getSlugHelperMap() (map[string]string, error) {
 	return slugHelperMap, nil
 }
 
+// Minimal 64-bit little-endian ELF header for a linux executable
+func elfHeader(machine elf.Machine) []byte {
+	b := make([]byte, 64)
+	copy(b, elf.ELFMAG)
+	b[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	b[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	b[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	b[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+	binary.LittleEndian.PutUint16(b[16:], uint16(elf.ET_EXEC))
+	binary.LittleEndian.PutUint16(b[18:], uint16(machine))
+	binary.LittleEndian.PutUint32(b[20:], uint32(elf.EV_CURRENT))
+	binary.LittleEndian.PutUint16(b[52:], 64)
+	return b
+}
+
+// Empty image with the given platform in its config
+func imageForPlatform(osName string, arch string) (v1.Image, error) {
+	cfg, err := empty.Image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS = osName
+	cfg.Architecture = arch
+	return mutate.ConfigFile(empty.Image, cfg)
+}
+
+// Transport which counts the requests made through it
+type countingTransport struct {
+	count int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Transport which cancels a context before making each request
+type cancelingTransport struct {
+	cancel context.CancelFunc
+}
+
+func (t *cancelingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.cancel()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 // Pull an image and return the filenames in the final layer and env
 func extractImage(ref string) ([]string, []string, error) {
 	pulled, err := crane.Pull(ref)
@@ -414,3 +1573,35 @@ func extractImage(ref string) ([]string, []string, error) {
 	env := cfg.Config.Env
 	return files, env, nil
 }
+
+// Pull an image and return the contents of a file in the final layer
+func extractFile(ref string, filename string) ([]byte, error) {
+	pulled, err := crane.Pull(ref)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := pulled.Layers()
+	if err != nil {
+		return nil, err
+	}
+	finalLayer := layers[len(layers)-1]
+	layerReader, err := finalLayer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer layerReader.Close()
+	tarReader := tar.NewReader(layerReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fmt.Sprintf("/%s", header.Name) == filename {
+			return ioutil.ReadAll(tarReader)
+		}
+	}
+	return nil, fmt.Errorf("%s not found in final layer", filename)
+}
@@ -0,0 +1,144 @@
+package magician
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+type (
+	// MutatePlan describes the result of a mutate operation: the new image
+	// (or index) and what was changed in each of its images.
+	MutatePlan struct {
+		Source      string             `json:"source"`
+		Destination string             `json:"destination"`
+		Digest      string             `json:"digest"`
+		Images      []*MutatePlanImage `json:"images"`
+	}
+
+	// MutatePlanImage describes the changes made to a single (platform) image.
+	// BaseDigest is the digest of the image which was pulled, and UnmutatedDigest
+	// that of the same image without any magic it already had (as recorded in
+	// the labels and annotations of the new image). These are the same unless
+	// an image is mutated again.
+	MutatePlanImage struct {
+		Platform        string             `json:"platform"`
+		BaseDigest      string             `json:"baseDigest"`
+		UnmutatedDigest string             `json:"unmutatedDigest"`
+		Digest          string             `json:"digest"`
+		Files           []MutatePlanFile   `json:"files"`
+		Env             []MutatePlanEnvVar `json:"env"`
+
+		image   v1.Image
+		helpers []mutateHelper
+	}
+
+	// MutatePlanFile is a file added to an image in the magic layer.
+	MutatePlanFile struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		Mode   string `json:"mode"`
+		Sha256 string `json:"sha256"`
+	}
+
+	// MutatePlanEnvVar is an env var in the image config, before and after mutation.
+	MutatePlanEnvVar struct {
+		Name string `json:"name"`
+		Old  string `json:"old"`
+		New  string `json:"new"`
+	}
+)
+
+// Env vars which are set by a mutate operation
+var magicEnvVars = []string{
+	constants.EnvVarPath,
+	constants.EnvVarDockerConfig,
+	constants.EnvVarDockerOrigConfig,
+	constants.EnvVarDockerCredentialMagicConfig,
+}
+
+// Plan runs a mutate operation without pushing anything (a "dry run"),
+// and returns a description of the image which would have been pushed.
+func Plan(source string, options ...MutateOption) (*MutatePlan, error) {
+	return PlanWithContext(context.Background(), source, options...)
+}
+
+// PlanWithContext is like Plan, but stops once the provided context is canceled or expires.
+func PlanWithContext(ctx context.Context, source string, options ...MutateOption) (*MutatePlan, error) {
+	operation, err := mutateRun(ctx, source, true, options...)
+	if err != nil {
+		return nil, err
+	}
+	return operation.runtime.plan, nil
+}
+
+// Changed reports whether the env var is modified by the mutate operation.
+func (envVar MutatePlanEnvVar) Changed() bool {
+	return envVar.Old != envVar.New
+}
+
+// Start describing a new image, built for the current platform
+func mutateUtilStartImagePlan(operation *mutateOperation) error {
+	baseDigest, err := operation.runtime.baseImage.Digest()
+	if err != nil {
+		return fmt.Errorf("base image digest: %v", err)
+	}
+	// Images without a platform in their config are treated as the default platform
+	platform := operation.runtime.platform
+	if platform == nil {
+		platform = &defaultPlatform
+	}
+	imagePlan := &MutatePlanImage{
+		Platform:        mutateUtilGetPlatformString(platform),
+		BaseDigest:      baseDigest.String(),
+		UnmutatedDigest: baseDigest.String(),
+	}
+	operation.runtime.plan.Images = append(operation.runtime.plan.Images, imagePlan)
+	operation.runtime.imagePlan = imagePlan
+	return nil
+}
+
+// List the files in a layer tarball
+func mutateUtilGetPlanFiles(b []byte) ([]MutatePlanFile, error) {
+	var files []MutatePlanFile
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading layer: %v", err)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, fmt.Errorf("reading layer file %s: %v", hdr.Name, err)
+		}
+		files = append(files, MutatePlanFile{
+			Path:   fmt.Sprintf("/%s", hdr.Name),
+			Size:   hdr.Size,
+			Mode:   fmt.Sprintf("%04o", hdr.Mode),
+			Sha256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+	return files, nil
+}
+
+// Record the values of the env vars set by mutate, before and after
+func mutateUtilGetPlanEnv(before *v1.ConfigFile, after *v1.ConfigFile) []MutatePlanEnvVar {
+	var env []MutatePlanEnvVar
+	for _, key := range magicEnvVars {
+		_, oldValue := mutateUtilGetImageConfigEnvVar(before, key)
+		_, newValue := mutateUtilGetImageConfigEnvVar(after, key)
+		env = append(env, MutatePlanEnvVar{Name: key, Old: oldValue, New: newValue})
+	}
+	return env
+}
@@ -0,0 +1,177 @@
+package magician
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// A helper binary added to an image, as recorded in its provenance
+type mutateHelper struct {
+	name    string
+	version string
+	sha256  string
+	url     string
+	license string
+}
+
+// Recorded instead of the path of a custom helpers or mappings dir, which
+// depends on the machine running magician
+const provenanceCustomDir = "<custom>"
+
+var (
+	// Labels which record the provenance of a mutated image
+	provenanceLabelKeys = []string{
+		constants.LabelHelpers,
+		constants.LabelSource,
+		constants.LabelSourceDigest,
+		constants.LabelVersion,
+	}
+
+	// Annotations which record the provenance of a mutated image
+	provenanceAnnotationKeys = []string{
+		constants.AnnotationBaseDigest,
+		constants.AnnotationBaseName,
+		constants.AnnotationHelpers,
+		constants.AnnotationOrigBaseDigest,
+		constants.AnnotationOrigBaseName,
+		constants.AnnotationVersion,
+	}
+
+	// Base annotations which may already be set (e.g. by the builder of the base image),
+	// and the annotations they are saved in so they can be restored by unmutate
+	provenanceOrigAnnotationKeys = map[string]string{
+		constants.AnnotationBaseDigest: constants.AnnotationOrigBaseDigest,
+		constants.AnnotationBaseName:   constants.AnnotationOrigBaseName,
+	}
+)
+
+// Format a helper as e.g. "ecr-login:0.5.0@sha256:<hex>" (the version is optional)
+func (helper mutateHelper) String() string {
+	s := helper.name
+	if helper.version != "" {
+		s = fmt.Sprintf("%s:%s", s, helper.version)
+	}
+	return fmt.Sprintf("%s@sha256:%s", s, helper.sha256)
+}
+
+// Name and version of the tool doing the mutation (normally "docker-credential-magician/<version>")
+func mutateUtilGetBuilder(operation *mutateOperation) string {
+	if operation.configurable.userAgent != "" {
+		return operation.configurable.userAgent
+	}
+	return constants.MagicianName
+}
+
+// The mutate operation, in the form of the equivalent magician command, e.g.
+// "docker-credential-magician/v0.6.0 mutate myimage:v1 --tag myimage:v1-magic --include aws"
+// (without the paths of custom helpers and mappings dirs)
+func mutateUtilGetCreatedBy(operation *mutateOperation) string {
+	args := []string{mutateUtilGetBuilder(operation), "mutate", operation.runtime.source}
+	if tag := operation.configurable.tag; tag != "" {
+		args = append(args, "--tag", tag)
+	}
+	for _, helper := range operation.runtime.requestedHelpers {
+		args = append(args, "--include", helper)
+	}
+	if operation.configurable.helpersDir != "" {
+		args = append(args, "--helpers-dir", provenanceCustomDir)
+	}
+	if operation.configurable.mappingsDir != "" {
+		args = append(args, "--mappings-dir", provenanceCustomDir)
+	}
+	if operation.configurable.disablePathLookup {
+		args = append(args, "--disable-path-lookup")
+	}
+	if operation.configurable.allowArchMismatch {
+		args = append(args, "--allow-arch-mismatch")
+	}
+	if platform := operation.configurable.platform; platform != nil {
+		args = append(args, "--platform", mutateUtilGetPlatformString(platform))
+	}
+	return strings.Join(args, " ")
+}
+
+// Labels for the config of an image built from the base image (with the given digest)
+func mutateUtilGetProvenanceLabels(operation *mutateOperation, baseDigest string) map[string]string {
+	return map[string]string{
+		constants.LabelHelpers:      mutateUtilGetHelpersString(operation.runtime.helpers),
+		constants.LabelSource:       operation.runtime.sourceLocation.String(),
+		constants.LabelSourceDigest: baseDigest,
+		constants.LabelVersion:      mutateUtilGetBuilder(operation),
+	}
+}
+
+// Annotations for the manifest of an image built from the base with the given digest and
+// manifest annotations. Base annotations already set on the base are saved, to be restored
+// by mutateUtilRemoveProvenanceAnnotations.
+func mutateUtilGetProvenanceAnnotations(operation *mutateOperation, baseDigest string,
+	baseAnnotations map[string]string) map[string]string {
+	annotations := map[string]string{
+		constants.AnnotationBaseDigest: baseDigest,
+		constants.AnnotationBaseName:   operation.runtime.sourceLocation.String(),
+		constants.AnnotationVersion:    mutateUtilGetBuilder(operation),
+	}
+	if len(operation.runtime.helpers) > 0 {
+		annotations[constants.AnnotationHelpers] = mutateUtilGetHelpersString(operation.runtime.helpers)
+	}
+	for key, origKey := range provenanceOrigAnnotationKeys {
+		if v, ok := baseAnnotations[key]; ok {
+			annotations[origKey] = v
+		}
+	}
+	return annotations
+}
+
+func mutateUtilGetHelpersString(helpers []mutateHelper) string {
+	var s string
+	for i, helper := range helpers {
+		if i > 0 {
+			s += ","
+		}
+		s += helper.String()
+	}
+	return s
+}
+
+// Copy labels, without those recording provenance (nil if none are left)
+func mutateUtilRemoveProvenanceLabels(labels map[string]string) map[string]string {
+	return mutateUtilRemoveKeys(labels, provenanceLabelKeys)
+}
+
+// Copy annotations, without those recording provenance but with any base
+// annotations which were set before mutating restored (nil if none are left)
+func mutateUtilRemoveProvenanceAnnotations(annotations map[string]string) map[string]string {
+	filtered := mutateUtilRemoveKeys(annotations, provenanceAnnotationKeys)
+	for key, origKey := range provenanceOrigAnnotationKeys {
+		if v, ok := annotations[origKey]; ok {
+			if filtered == nil {
+				filtered = map[string]string{}
+			}
+			filtered[key] = v
+		}
+	}
+	return filtered
+}
+
+func mutateUtilRemoveKeys(values map[string]string, keys []string) map[string]string {
+	var filtered map[string]string
+	for k, v := range values {
+		var remove bool
+		for _, key := range keys {
+			if k == key {
+				remove = true
+				break
+			}
+		}
+		if remove {
+			continue
+		}
+		if filtered == nil {
+			filtered = map[string]string{}
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
@@ -0,0 +1,186 @@
+package magician
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// An OCI 1.1 artifact manifest referring to the new image (or index) as its subject,
+// see https://github.com/opencontainers/image-spec/blob/v1.1.0/manifest.md
+type (
+	referrerManifest struct {
+		SchemaVersion int64                `json:"schemaVersion"`
+		MediaType     types.MediaType      `json:"mediaType"`
+		ArtifactType  string               `json:"artifactType"`
+		Config        referrerDescriptor   `json:"config"`
+		Layers        []referrerDescriptor `json:"layers"`
+		Subject       *referrerDescriptor  `json:"subject,omitempty"`
+		Annotations   map[string]string    `json:"annotations,omitempty"`
+	}
+
+	// The index of referrers, pushed with the fallback tag "sha256-<digest>" for
+	// registries without the referrers API
+	referrerIndex struct {
+		SchemaVersion int64                `json:"schemaVersion"`
+		MediaType     types.MediaType      `json:"mediaType"`
+		Manifests     []referrerDescriptor `json:"manifests"`
+	}
+
+	// v1.Descriptor, with the artifact type it lacks
+	referrerDescriptor struct {
+		MediaType    types.MediaType   `json:"mediaType"`
+		ArtifactType string            `json:"artifactType,omitempty"`
+		Digest       v1.Hash           `json:"digest"`
+		Size         int64             `json:"size"`
+		Annotations  map[string]string `json:"annotations,omitempty"`
+	}
+
+	// A raw manifest to be pushed with remote.Put
+	referrerTaggable struct {
+		raw       []byte
+		mediaType types.MediaType
+	}
+)
+
+func (t *referrerTaggable) RawManifest() ([]byte, error) {
+	return t.raw, nil
+}
+
+func (t *referrerTaggable) MediaType() (types.MediaType, error) {
+	return t.mediaType, nil
+}
+
+// Push the blob as an artifact (with a single layer) whose subject is the new image
+// (or index), and add it to the referrers fallback tag "sha256-<digest>" so that it
+// is also found on registries without the referrers API. Returns the artifact digest.
+func mutateUtilPushReferrer(operation *mutateOperation, artifactType string, blob []byte,
+	mediaType string, annotations map[string]string) (v1.Hash, error) {
+	subject, err := mutateUtilGetReferrerSubject(operation)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	repo := operation.runtime.destination.ref.Context()
+	opts := mutateUtilGetRemoteOptions(operation, operation.runtime.dstKeychain,
+		operation.configurable.dst.auth, operation.runtime.dstTransport)
+
+	config, err := mutateUtilWriteReferrerBlob(repo, opts,
+		static.NewLayer([]byte(constants.OCIEmptyJSON), types.MediaType(constants.OCIEmptyMediaType)))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	layer, err := mutateUtilWriteReferrerBlob(repo, opts, static.NewLayer(blob, types.MediaType(mediaType)))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	manifest := referrerManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  artifactType,
+		Config:        *config,
+		Layers:        []referrerDescriptor{*layer},
+		Subject:       subject,
+		Annotations:   annotations,
+	}
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("encoding referrer manifest: %v", err)
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	artifact := &referrerTaggable{raw: raw, mediaType: manifest.MediaType}
+	if err := remote.Put(repo.Digest(digest.String()), artifact, opts...); err != nil {
+		return v1.Hash{}, fmt.Errorf("remote write referrer: %v", err)
+	}
+
+	// Add the artifact to the fallback index, replacing any previous entry for it
+	tag := repo.Tag(fmt.Sprintf("%s-%s", subject.Digest.Algorithm, subject.Digest.Hex))
+	index := referrerIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	existing, err := remote.Get(tag, opts...)
+	if err != nil {
+		var terr *transport.Error
+		if !errors.As(err, &terr) || terr.StatusCode != http.StatusNotFound {
+			return v1.Hash{}, fmt.Errorf("loading existing referrers: %v", err)
+		}
+	} else if err := json.Unmarshal(existing.Manifest, &index); err != nil {
+		return v1.Hash{}, fmt.Errorf("parsing existing referrers: %v", err)
+	}
+	manifests := []referrerDescriptor{}
+	for _, desc := range index.Manifests {
+		if desc.Digest != digest {
+			manifests = append(manifests, desc)
+		}
+	}
+	index.Manifests = append(manifests, referrerDescriptor{
+		MediaType:    manifest.MediaType,
+		ArtifactType: artifactType,
+		Digest:       digest,
+		Size:         size,
+		Annotations:  annotations,
+	})
+	raw, err = json.Marshal(index)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("encoding referrers index: %v", err)
+	}
+	if err := remote.Put(tag, &referrerTaggable{raw: raw, mediaType: index.MediaType}, opts...); err != nil {
+		return v1.Hash{}, fmt.Errorf("remote write referrers index: %v", err)
+	}
+	return digest, nil
+}
+
+// The descriptor of the new image (or index), as pushed to the destination
+func mutateUtilGetReferrerSubject(operation *mutateOperation) (*referrerDescriptor, error) {
+	var manifest interface {
+		MediaType() (types.MediaType, error)
+		Size() (int64, error)
+	} = operation.runtime.newImage
+	if operation.runtime.newIndex != nil {
+		manifest = operation.runtime.newIndex
+	}
+	mediaType, err := manifest.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("subject media type: %v", err)
+	}
+	size, err := manifest.Size()
+	if err != nil {
+		return nil, fmt.Errorf("subject size: %v", err)
+	}
+	digest, err := v1.NewHash(operation.runtime.plan.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing digest: %v", err)
+	}
+	return &referrerDescriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
+
+// Upload a blob of the artifact, returning its descriptor
+func mutateUtilWriteReferrerBlob(repo name.Repository, opts []remote.Option, layer v1.Layer) (*referrerDescriptor, error) {
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return nil, err
+	}
+	if err := remote.WriteLayer(repo, layer, opts...); err != nil {
+		return nil, fmt.Errorf("remote write blob: %v", err)
+	}
+	return &referrerDescriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
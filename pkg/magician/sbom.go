@@ -0,0 +1,173 @@
+package magician
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+// Value for unknown fields in an SPDX document
+const spdxNoAssertion = "NOASSERTION"
+
+// Characters not allowed in SPDX identifiers
+var spdxInvalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+// A minimal SPDX 2.2 document (JSON), see https://spdx.github.io/spdx-spec/v2.2.2/
+type (
+	spdxDocument struct {
+		SPDXVersion       string             `json:"spdxVersion"`
+		DataLicense       string             `json:"dataLicense"`
+		SPDXID            string             `json:"SPDXID"`
+		Name              string             `json:"name"`
+		DocumentNamespace string             `json:"documentNamespace"`
+		CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+		Packages          []spdxPackage      `json:"packages"`
+		Relationships     []spdxRelationship `json:"relationships"`
+	}
+
+	spdxCreationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+
+	spdxPackage struct {
+		SPDXID           string         `json:"SPDXID"`
+		Name             string         `json:"name"`
+		VersionInfo      string         `json:"versionInfo,omitempty"`
+		DownloadLocation string         `json:"downloadLocation"`
+		Homepage         string         `json:"homepage,omitempty"`
+		FilesAnalyzed    bool           `json:"filesAnalyzed"`
+		Checksums        []spdxChecksum `json:"checksums"`
+		LicenseConcluded string         `json:"licenseConcluded"`
+		LicenseDeclared  string         `json:"licenseDeclared"`
+		CopyrightText    string         `json:"copyrightText"`
+		Comment          string         `json:"comment,omitempty"`
+	}
+
+	spdxChecksum struct {
+		Algorithm     string `json:"algorithm"`
+		ChecksumValue string `json:"checksumValue"`
+	}
+
+	spdxRelationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+)
+
+func mutateStepWriteSBOM(operation *mutateOperation) error {
+	sbomFile, sbomAttach := operation.configurable.sbomFile, operation.configurable.sbomAttach
+	if sbomFile == "" && !sbomAttach {
+		return nil
+	}
+	b, err := json.MarshalIndent(mutateUtilBuildSBOM(operation), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding SBOM: %v", err)
+	}
+	b = append(b, '\n')
+	if sbomFile != "" {
+		operation.runtime.logger.Printf("Writing SBOM to %s ...\n", sbomFile)
+		if err := ioutil.WriteFile(sbomFile, b, 0644); err != nil {
+			return fmt.Errorf("writing SBOM: %v", err)
+		}
+	}
+	if sbomAttach {
+		subject := operation.runtime.destination.ref.Context().Digest(operation.runtime.plan.Digest)
+		operation.runtime.logger.Printf("Attaching SBOM to %s ...\n", subject.String())
+		if _, err := mutateUtilPushReferrer(operation, constants.SBOMMediaType, b, constants.SBOMMediaType, nil); err != nil {
+			return fmt.Errorf("attach SBOM: %v", err)
+		}
+	}
+	return nil
+}
+
+// Build an SPDX document describing the new image (or each image of the new index),
+// with a package for each helper binary added to it
+func mutateUtilBuildSBOM(operation *mutateOperation) *spdxDocument {
+	plan := operation.runtime.plan
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              plan.Destination,
+		DocumentNamespace: fmt.Sprintf("%s/spdx/%s", constants.MagicURL, strings.Replace(plan.Digest, ":", "-", 1)),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{fmt.Sprintf("Tool: %s", mutateUtilGetBuilder(operation))},
+		},
+	}
+	for _, imagePlan := range plan.Images {
+		imageID := mutateUtilGetSPDXID("Image", imagePlan.Platform)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           imageID,
+			Name:             plan.Destination,
+			VersionInfo:      imagePlan.Digest,
+			DownloadLocation: spdxNoAssertion,
+			Checksums:        []spdxChecksum{mutateUtilGetSPDXChecksum(imagePlan.Digest)},
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+			Comment:          fmt.Sprintf("Image for platform %s, built from %s", imagePlan.Platform, imagePlan.BaseDigest),
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      doc.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: imageID,
+		})
+		for _, helper := range imagePlan.helpers {
+			helperID := mutateUtilGetSPDXID("Package", imagePlan.Platform, helper.name)
+			pkg := spdxPackage{
+				SPDXID:           helperID,
+				Name:             fmt.Sprintf("%s-%s", constants.DockerCredentialPrefix, helper.name),
+				VersionInfo:      helper.version,
+				DownloadLocation: spdxNoAssertion,
+				Homepage:         helper.url,
+				Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: helper.sha256}},
+				LicenseConcluded: spdxNoAssertion,
+				LicenseDeclared:  spdxNoAssertion,
+				CopyrightText:    spdxNoAssertion,
+			}
+			if helper.name == constants.MagicCredentialSuffix {
+				pkg.VersionInfo = mutateUtilGetMagicVersion(operation)
+			}
+			if helper.url != "" {
+				pkg.DownloadLocation = helper.url
+			}
+			if helper.license != "" {
+				pkg.LicenseDeclared = helper.license
+			}
+			doc.Packages = append(doc.Packages, pkg)
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      imageID,
+				RelationshipType:   "CONTAINS",
+				RelatedSPDXElement: helperID,
+			})
+		}
+	}
+	return doc
+}
+
+// The magic binary is released along with magician, so has the same version
+// (e.g. "v0.6.0" from the user agent "docker-credential-magician/v0.6.0")
+func mutateUtilGetMagicVersion(operation *mutateOperation) string {
+	userAgent := operation.configurable.userAgent
+	if i := strings.LastIndex(userAgent, "/"); i >= 0 {
+		return userAgent[i+1:]
+	}
+	return ""
+}
+
+func mutateUtilGetSPDXID(kind string, parts ...string) string {
+	id := fmt.Sprintf("SPDXRef-%s-%s", kind, strings.Join(parts, "-"))
+	return spdxInvalidIDChars.ReplaceAllString(id, "-")
+}
+
+func mutateUtilGetSPDXChecksum(digest string) spdxChecksum {
+	return spdxChecksum{Algorithm: "SHA256", ChecksumValue: strings.TrimPrefix(digest, "sha256:")}
+}
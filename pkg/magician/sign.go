@@ -0,0 +1,171 @@
+package magician
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/docker-credential-magic/docker-credential-magic/internal/constants"
+)
+
+type (
+	// Signer signs the simple-signing payload of a mutated image, to be verified by cosign.
+	Signer interface {
+		// Sign returns the raw signature of payload: for ECDSA keys, an ASN.1 signature
+		// of the sha256 digest of payload, and for ed25519 keys, a signature of payload itself.
+		Sign(payload []byte) ([]byte, error)
+	}
+
+	// Signs with a private key loaded from a file
+	keySigner struct {
+		key crypto.Signer
+	}
+
+	// Simple signing payload, as produced by "cosign sign"
+	simpleSigningPayload struct {
+		Critical simpleSigningCritical  `json:"critical"`
+		Optional map[string]interface{} `json:"optional"`
+	}
+
+	simpleSigningCritical struct {
+		Identity simpleSigningIdentity `json:"identity"`
+		Image    simpleSigningImage    `json:"image"`
+		Type     string                `json:"type"`
+	}
+
+	simpleSigningIdentity struct {
+		DockerReference string `json:"docker-reference"`
+	}
+
+	simpleSigningImage struct {
+		DockerManifestDigest string `json:"docker-manifest-digest"`
+	}
+)
+
+// NewSignerFromKeyFile loads an unencrypted PEM private key (ECDSA or ed25519, in PKCS #8
+// or SEC 1 form, e.g. created with "openssl genpkey") to sign mutated images with.
+func NewSignerFromKeyFile(keyFile string) (Signer, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in key file %s", keyFile)
+	}
+	switch {
+	case block.Type == "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing EC private key: %v", err)
+		}
+		return &keySigner{key: key}, nil
+	case block.Type == "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %v", err)
+		}
+		switch k := key.(type) {
+		case *ecdsa.PrivateKey:
+			return &keySigner{key: k}, nil
+		case ed25519.PrivateKey:
+			return &keySigner{key: k}, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T, must be ECDSA or ed25519", key)
+	case strings.Contains(block.Type, "ENCRYPTED"):
+		return nil, fmt.Errorf("encrypted private keys are not supported, decrypt %s first", keyFile)
+	}
+	return nil, fmt.Errorf("unsupported PEM block type %q in key file %s", block.Type, keyFile)
+}
+
+func (signer *keySigner) Sign(payload []byte) ([]byte, error) {
+	if _, ok := signer.key.(ed25519.PrivateKey); ok {
+		return signer.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// Sign the new image (or index) and push the signature next to it, tagged "sha256-<digest>.sig",
+// adding to any signatures already there (as done by "cosign sign")
+func mutateStepSignNewImage(operation *mutateOperation) error {
+	signer := operation.configurable.signer
+	if signer == nil {
+		return nil
+	}
+	digest, err := v1.NewHash(operation.runtime.plan.Digest)
+	if err != nil {
+		return fmt.Errorf("parsing digest: %v", err)
+	}
+	repo := operation.runtime.destination.ref.Context()
+	payload, err := json.Marshal(simpleSigningPayload{
+		Critical: simpleSigningCritical{
+			Identity: simpleSigningIdentity{DockerReference: repo.Name()},
+			Image:    simpleSigningImage{DockerManifestDigest: digest.String()},
+			Type:     constants.SimpleSigningType,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encoding signature payload: %v", err)
+	}
+	signature, err := signer.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("signing: %v", err)
+	}
+
+	tag := repo.Tag(fmt.Sprintf("%s-%s%s", digest.Algorithm, digest.Hex, constants.SignatureTagSuffix))
+	operation.runtime.logger.Printf("Pushing signature to %s ...\n", tag.String())
+	opts := mutateUtilGetRemoteOptions(operation, operation.runtime.dstKeychain,
+		operation.configurable.dst.auth, operation.runtime.dstTransport)
+	img, err := mutateUtilGetSignatureImage(tag, opts)
+	if err != nil {
+		return err
+	}
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer: static.NewLayer(payload, types.MediaType(constants.SimpleSigningMediaType)),
+		Annotations: map[string]string{
+			constants.AnnotationCosignSignature: base64.StdEncoding.EncodeToString(signature),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("append signature layer: %v", err)
+	}
+	if err := remote.Write(tag, img, opts...); err != nil {
+		return fmt.Errorf("remote write signature: %v", err)
+	}
+	return nil
+}
+
+// Existing signatures for an image, or an empty signature image if there are none
+func mutateUtilGetSignatureImage(tag name.Tag, opts []remote.Option) (v1.Image, error) {
+	img, err := remote.Image(tag, opts...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			img = mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+			return mutate.ConfigMediaType(img, types.OCIConfigJSON), nil
+		}
+		return nil, fmt.Errorf("loading existing signatures: %v", err)
+	}
+	return img, nil
+}
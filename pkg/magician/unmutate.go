@@ -0,0 +1,80 @@
+package magician
+
+import (
+	"context"
+	"fmt"
+)
+
+// Unmutate takes an image previously built by Mutate, removes the magic layer and restores
+// the original env vars (PATH, DOCKER_CONFIG, etc.), then pushes the result back to the
+// registry (at the same reference unless otherwise specified with MutateOptWithTag).
+//
+// Options which only affect the helpers added by Mutate (e.g. MutateOptWithIncludeHelpers)
+// are ignored.
+func Unmutate(source string, options ...MutateOption) error {
+	return UnmutateWithContext(context.Background(), source, options...)
+}
+
+// UnmutateWithContext is like Unmutate, but stops between steps (and aborts any
+// pull or push in progress) once the provided context is canceled or expires.
+func UnmutateWithContext(ctx context.Context, source string, options ...MutateOption) error {
+	operation := mutateUtilNewOperation(ctx, source, options...)
+	if err := mutateUtilRunSteps(operation, []mutateStep{
+		mutateStepSetLogger,
+		mutateStepSetDestination,
+		mutateStepSetKeychains,
+		mutateStepSetTransports,
+		mutateStepPullBaseImage,
+		unmutateStepBuildNewImage,
+		mutateStepPushNewImage,
+	}); err != nil {
+		return err
+	}
+	operation.runtime.logger.Println("Done.")
+	return nil
+}
+
+func unmutateStepBuildNewImage(operation *mutateOperation) error {
+	if operation.runtime.baseIndex != nil {
+		if operation.configurable.platform == nil {
+			if err := mutateUtilBuildNewIndex(operation, unmutateUtilBuildNewImage); err != nil {
+				return err
+			}
+			if operation.runtime.numUnmutated == 0 {
+				return fmt.Errorf("no magic layer found in index %q", operation.runtime.source)
+			}
+			return nil
+		}
+		if err := mutateUtilSelectPlatformImage(operation); err != nil {
+			return err
+		}
+	}
+	if err := unmutateUtilBuildNewImage(operation); err != nil {
+		return err
+	}
+	if operation.runtime.numUnmutated == 0 {
+		return fmt.Errorf("no magic layer found in %q", operation.runtime.source)
+	}
+	return nil
+}
+
+// Build the new image from the base image without its magic layer, or keep
+// the base image as-is if it has none (e.g. for one platform of an index)
+func unmutateUtilBuildNewImage(operation *mutateOperation) error {
+	hasMagicLayer, err := mutateUtilHasMagicLayer(operation.runtime.baseImage)
+	if err != nil {
+		return err
+	}
+	if !hasMagicLayer {
+		operation.runtime.logger.Println("No magic layer found, keeping image as-is ...")
+		operation.runtime.newImage = operation.runtime.baseImage
+		return nil
+	}
+	operation.runtime.logger.Println("Removing magic layer and restoring env vars ...")
+	operation.runtime.newImage, err = mutateUtilRemoveMagicLayer(operation.runtime.baseImage)
+	if err != nil {
+		return fmt.Errorf("removing magic layer: %v", err)
+	}
+	operation.runtime.numUnmutated++
+	return nil
+}
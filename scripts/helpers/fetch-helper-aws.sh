@@ -4,6 +4,7 @@
 
 set -ex
 
+# (keep in sync with the version in mappings/aws.yml)
 ECR_HELPER_VERSION="0.5.0"
 ECR_HELPER_BINARY_SHA256="a0ae9a66b1f41f3312785ec5e17404c7fd2a16a35703c9ea7c050406e20fc503"
 
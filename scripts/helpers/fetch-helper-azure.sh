@@ -4,6 +4,7 @@
 
 set -ex
 
+# (keep in sync with the version in mappings/azure.yml)
 ACR_HELPER_VERSION="0.6.0"
 ACR_HELPER_TARBALL_SHA256="97a2d8079317dcc6807347689a6775779d31e1f745890aca270429bc1ad3fe11"
 ACR_HELPER_BINARY_SHA256="98ea9e979fd9a1094209b39f783e6a4d8c5d864f979d8078cdc348e2c6d39530"
@@ -4,6 +4,7 @@
 
 set -ex
 
+# (keep in sync with the version in mappings/gcp.yml)
 GCR_HELPER_VERSION="2.1.0"
 GCR_HELPER_TARBALL_SHA256="91cca7b5ca33133bcd217982be31d670efe7f1a33eb5be72e014f74feecac00f"
 GCR_HELPER_BINARY_SHA256="14738e12a09893c25a4952a4661f2e96304d231c4f7f1854e9d9288fcbfecc3e"